@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+	"sigs.k8s.io/yaml"
+)
+
+// checkResult is the structured report printed by check with --output json or yaml
+type checkResult struct {
+	Allowed bool          `json:"allowed"`
+	Reports []*pkg.Report `json:"reports"`
+}
+
+func runCheck(args []string) int {
+	flags := newFlagSet("check", "<manifest>...", "Validate workload, RoleBinding and ClusterRoleBinding manifests like the webhook would for the given requester.\nExits with 1 if any manifest is denied and with 2 on errors.")
+	offline := registerOfflineFlags(flags)
+	output := flags.String("output", "text", "Output format: text, json or yaml")
+	flags.Parse(args)
+	if *output != "text" && *output != "json" && *output != "yaml" {
+		return printError(errors.New("Unknown output format: " + *output))
+	}
+
+	saRbacValidatorConfig, requests, err := offline.load(flags.Args())
+	if err != nil {
+		return printError(err)
+	}
+
+	result := checkResult{Allowed: true, Reports: []*pkg.Report{}}
+	for _, request := range requests {
+		evaluate := pkg.Evaluate
+		if request.isBinding() {
+			evaluate = pkg.EvaluateBinding
+		}
+		report := evaluate(context.Background(), request.request, saRbacValidatorConfig)
+		result.Reports = append(result.Reports, report)
+		if !report.Allowed {
+			result.Allowed = false
+		}
+	}
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return printError(err)
+		}
+	case "yaml":
+		data, err := yaml.Marshal(result)
+		if err != nil {
+			return printError(err)
+		}
+		os.Stdout.Write(data)
+	default:
+		if err := printCheckText(offline, result); err != nil {
+			return printError(err)
+		}
+	}
+	if !result.Allowed {
+		return 1
+	}
+	return 0
+}
+
+func printCheckText(offline *offlineFlags, result checkResult) error {
+	for _, report := range result.Reports {
+		name := report.Kind + " " + report.Namespace + "/" + report.Name
+		if report.Allowed {
+			fmt.Printf("ALLOWED %s\n", name)
+			printWarnings(report.Warnings)
+			continue
+		}
+		fmt.Printf("DENIED  %s (%s)\n", name, report.Reason)
+		printWarnings(report.Warnings)
+		if len(report.BoundServiceAccounts) > 0 {
+			fmt.Println("  Bound ServiceAccounts: " + strings.Join(report.BoundServiceAccounts, ", "))
+		}
+		if len(report.TokenServiceAccounts) > 0 {
+			fmt.Println("  Token ServiceAccounts: " + strings.Join(report.TokenServiceAccounts, ", "))
+		}
+		if len(report.ReachableServiceAccounts) > 0 {
+			fmt.Println("  Reachable ServiceAccounts: " + strings.Join(report.ReachableServiceAccounts, ", "))
+		}
+		if !report.IsEscalation() {
+			fmt.Println("  " + report.Message)
+			continue
+		}
+		if err := offline.printRules("Cluster-Scope", report.ClusterEscalations); err != nil {
+			return err
+		}
+		for _, namespace := range report.EscalatedNamespaces() {
+			if err := offline.printRules("Namespace "+namespace, report.NamespacedEscalations[namespace]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printWarnings(warnings []string) {
+	for _, warning := range warnings {
+		fmt.Println("  Warning: " + warning)
+	}
+}
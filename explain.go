@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func runExplain(args []string) int {
+	flags := newFlagSet("explain", "<manifest>...", "Print the ServiceAccount, the permissions of the ServiceAccount and the requester and the decision for workload manifests.")
+	offline := registerOfflineFlags(flags)
+	flags.Parse(args)
+
+	saRbacValidatorConfig, requests, err := offline.load(flags.Args())
+	if err != nil {
+		return printError(err)
+	}
+
+	for _, request := range requests {
+		fmt.Println(request)
+		serviceAccount, err := util.ExtractServiceAccount(request.request, saRbacValidatorConfig.ServiceAccountJsonPointer)
+		if err != nil {
+			fmt.Println("  ServiceAccount: not found: " + err.Error())
+		} else {
+			fmt.Println("  ServiceAccount: " + request.request.Namespace + "/" + serviceAccount)
+			serviceAccountUser, err := saRbacValidatorConfig.Source.GetServiceAccount(serviceAccount, request.request.Namespace)
+			if err != nil {
+				return printError(err)
+			}
+			if err := printPermissions(offline, "ServiceAccount permissions", serviceAccountUser, saRbacValidatorConfig); err != nil {
+				return printError(err)
+			}
+		}
+		if err := printPermissions(offline, "Requester permissions", util.ExtractUser(request.request), saRbacValidatorConfig); err != nil {
+			return printError(err)
+		}
+		response := pkg.Validate(context.Background(), request.request, saRbacValidatorConfig)
+		if response.Allowed {
+			fmt.Println("  Decision: ALLOWED")
+		} else {
+			fmt.Println("  Decision: DENIED")
+		}
+		fmt.Println("  Message: " + response.Result.Message)
+	}
+	return 0
+}
+
+func printPermissions(offline *offlineFlags, title string, subject user.Info, saRbacValidatorConfig pkg.SaRbacValidatorConfig) error {
+	namespacedRules, err := pkg.GetNamespacedPermissions(subject, saRbacValidatorConfig)
+	if err != nil {
+		return err
+	}
+	clusterRules, err := pkg.GetClusterPermissions(subject, saRbacValidatorConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Println("  " + title + ":")
+	if err := offline.printRules("Cluster-Scope", clusterRules); err != nil {
+		return err
+	}
+	namespaces := make([]string, 0, len(namespacedRules))
+	for namespace := range namespacedRules {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		if err := offline.printRules("Namespace "+namespace, namespacedRules[namespace]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+)
+
+// Every flag defaults to the value of its environment variable, so flags take precedence over the environment
+
+func stringFlag(flags *flag.FlagSet, name string, env string, defaultValue string, usage string) *string {
+	if value := os.Getenv(env); value != "" {
+		defaultValue = value
+	}
+	return flags.String(name, defaultValue, usage+" (env: "+env+")")
+}
+
+func boolFlag(flags *flag.FlagSet, name string, env string, defaultValue bool, usage string) *bool {
+	if value := os.Getenv(env); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			exitInvalidEnv(env, err)
+		}
+		defaultValue = parsed
+	}
+	return flags.Bool(name, defaultValue, usage+" (env: "+env+")")
+}
+
+func durationFlag(flags *flag.FlagSet, name string, env string, defaultValue time.Duration, usage string) *time.Duration {
+	if value := os.Getenv(env); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			exitInvalidEnv(env, err)
+		}
+		defaultValue = parsed
+	}
+	return flags.Duration(name, defaultValue, usage+" (env: "+env+")")
+}
+
+func int64Flag(flags *flag.FlagSet, name string, env string, defaultValue int64, usage string) *int64 {
+	if value := os.Getenv(env); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			exitInvalidEnv(env, err)
+		}
+		defaultValue = parsed
+	}
+	return flags.Int64(name, defaultValue, usage+" (env: "+env+")")
+}
+
+func exitInvalidEnv(env string, err error) {
+	fmt.Fprintln(os.Stderr, "Failed to parse "+env+": "+err.Error())
+	os.Exit(2)
+}
+
+// stringSliceFlag collects the values of a flag that can be passed multiple times
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// configFlags are the settings of pkg.Config which are shared by all commands that validate requests
+type configFlags struct {
+	flags              *flag.FlagSet
+	configFile         *string
+	logLevel           *string
+	saJsonPointer      *string
+	saNotFoundBehavior *string
+	criticalPermission *string
+	transitive         *bool
+}
+
+func registerConfigFlags(flags *flag.FlagSet) configFlags {
+	return configFlags{
+		flags:              flags,
+		configFile:         stringFlag(flags, "config", "SA_RBAC_VALIDATOR_CONFIG_FILE", "", "Path to a YAML or JSON config file, flags take precedence over its values"),
+		logLevel:           stringFlag(flags, "log-level", "SA_RBAC_VALIDATOR_LOG_LEVEL", "", "Log level: trace, debug, info, warn, error"),
+		saJsonPointer:      stringFlag(flags, "sa-json-pointer", "SA_RBAC_VALIDATOR_SA_JSONPATH", "", "JSON pointer to the ServiceAccount name in the admitted object, e.g. /spec/serviceAccountName"),
+		saNotFoundBehavior: stringFlag(flags, "sa-not-found-behavior", "SA_RBAC_VALIDATOR_SA_NOT_FOUND_BEHAVIOR", "", "Decision if no ServiceAccount is found under the JSON pointer: deny or allow"),
+		criticalPermission: stringFlag(flags, "critical-permission-behavior", "SA_RBAC_VALIDATOR_CRITICAL_PERMISSION_BEHAVIOR", "", "Decision if the ServiceAccount holds escalate, bind or impersonate and the requester is not exempted: deny or allow"),
+		transitive:         boolFlag(flags, "transitive-analysis", "SA_RBAC_VALIDATOR_TRANSITIVE_ANALYSIS", false, "Also compare the permissions of all ServiceAccounts the ServiceAccount can act as through tokens, workloads or Secrets"),
+	}
+}
+
+func (c configFlags) overrides() pkg.Config {
+	overrides := pkg.Config{
+		LogLevel:                   *c.logLevel,
+		ServiceAccountJsonPointer:  *c.saJsonPointer,
+		SaNotFoundBehavior:         *c.saNotFoundBehavior,
+		CriticalPermissionBehavior: *c.criticalPermission,
+	}
+	// false is a valid bool value, so bool flags only override the config file if they are set explicitly
+	if c.isSet("transitive-analysis", "SA_RBAC_VALIDATOR_TRANSITIVE_ANALYSIS") {
+		overrides.TransitiveAnalysis = c.transitive
+	}
+	return overrides
+}
+
+// isSet reports if the flag was passed on the command line or its environment variable is set
+func (c configFlags) isSet(name string, env string) bool {
+	set := os.Getenv(env) != ""
+	c.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// newFlagSet returns a flag set whose usage documents the command and all of its flags
+func newFlagSet(name string, arguments string, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sa-rbac-validator %s [flags] %s\n\n%s\n\nFlags:\n", name, arguments, description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+const snapshotTimeout = 60 * time.Second
+
+// offlineFlags are shared by the commands that validate manifests without a cluster
+type offlineFlags struct {
+	config      configFlags
+	rbac        stringSliceFlag
+	user        *string
+	groups      stringSliceFlag
+	namespace   *string
+	fromCluster *bool
+	kubeconfig  *string
+	kubeContext *string
+	rulesFormat *string
+	legacyToken *bool
+}
+
+func registerOfflineFlags(flags *flag.FlagSet) *offlineFlags {
+	offline := &offlineFlags{config: registerConfigFlags(flags)}
+	flags.Var(&offline.rbac, "rbac", "File or directory with Role, ClusterRole, RoleBinding, ClusterRoleBinding, Namespace and ServiceAccount token Secret manifests, can be repeated")
+	offline.user = flags.String("user", "", "Name of the requesting user")
+	flags.Var(&offline.groups, "group", "Group of the requesting user, can be repeated")
+	offline.namespace = flags.String("namespace", "default", "Namespace of manifests without namespace")
+	offline.fromCluster = flags.Bool("from-cluster", false, "Take a snapshot of the Roles, ClusterRoles, bindings and Namespaces of a live cluster, combined with --rbac")
+	offline.kubeconfig = stringFlag(flags, "kubeconfig", "SA_RBAC_VALIDATOR_KUBECONFIG", "", "Path to the kubeconfig used with --from-cluster")
+	offline.kubeContext = stringFlag(flags, "context", "SA_RBAC_VALIDATOR_KUBE_CONTEXT", "", "Kubeconfig context used with --from-cluster")
+	offline.legacyToken = flags.Bool("legacy-token-analysis", false, "Add the permissions of the ServiceAccounts whose token Secrets of --rbac or the cluster the ServiceAccount can read")
+	offline.rulesFormat = flags.String("rules-format", util.RulesFormatTable, "Format of printed rules: table, yaml or json")
+	return offline
+}
+
+// offlineRequest is an AdmissionRequest built from a workload manifest
+type offlineRequest struct {
+	request *admissionv1.AdmissionRequest
+}
+
+// isBinding reports if the manifest is validated like the validate-bindings endpoint does
+func (r offlineRequest) isBinding() bool {
+	return r.request.Kind.Group == rbacv1.GroupName && (r.request.Kind.Kind == "RoleBinding" || r.request.Kind.Kind == "ClusterRoleBinding")
+}
+
+func (r offlineRequest) String() string {
+	return r.request.Kind.Kind + " " + r.request.Namespace + "/" + r.request.Name
+}
+
+// load builds the SaRbacValidatorConfig from the RBAC manifests and an AdmissionRequest for every workload manifest
+func (o *offlineFlags) load(manifestPaths []string) (pkg.SaRbacValidatorConfig, []offlineRequest, error) {
+	if len(manifestPaths) == 0 {
+		return pkg.SaRbacValidatorConfig{}, nil, errors.New("No workload manifests given")
+	}
+	if *o.user == "" && len(o.groups) == 0 {
+		return pkg.SaRbacValidatorConfig{}, nil, errors.New("The requester must be given with --user and/or --group")
+	}
+	if _, err := util.RenderRules(nil, *o.rulesFormat); err != nil {
+		return pkg.SaRbacValidatorConfig{}, nil, err
+	}
+	overrides := o.config.overrides()
+	if overrides.LogLevel == "" {
+		overrides.LogLevel = "warn"
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr})
+	configLoader, err := pkg.NewConfigLoader(*o.config.configFile, 0, overrides, logger)
+	if err != nil {
+		return pkg.SaRbacValidatorConfig{}, nil, err
+	}
+
+	rbacManifests, err := util.ReadManifests(o.rbac)
+	if err != nil {
+		return pkg.SaRbacValidatorConfig{}, nil, err
+	}
+	objects := pkg.DecodeRBACObjects(rbacManifests, *o.namespace, logger)
+	if *o.fromCluster {
+		snapshot, err := o.snapshot()
+		if err != nil {
+			return pkg.SaRbacValidatorConfig{}, nil, err
+		}
+		objects = append(objects, snapshot...)
+	}
+	saRbacValidatorConfig := pkg.SaRbacValidatorConfig{
+		Logger:              logger,
+		Source:              pkg.NewMemoryRBACSource(objects...),
+		LegacyTokenAnalysis: *o.legacyToken,
+	}
+
+	workloadManifests, err := util.ReadManifests(manifestPaths)
+	if err != nil {
+		return pkg.SaRbacValidatorConfig{}, nil, err
+	}
+	userInfo := authenticationv1.UserInfo{
+		Username: *o.user,
+		Groups:   append([]string(o.groups), "system:authenticated"),
+	}
+	var requests []offlineRequest
+	for _, manifest := range workloadManifests {
+		request, err := pkg.NewAdmissionRequest(manifest, userInfo, *o.namespace)
+		if err != nil {
+			return pkg.SaRbacValidatorConfig{}, nil, err
+		}
+		requests = append(requests, offlineRequest{request: request})
+	}
+	return configLoader.Current().Apply(saRbacValidatorConfig), requests, nil
+}
+
+// printRules prints the compacted rules of scope in the format of --rules-format
+func (o *offlineFlags) printRules(scope string, rules []rbacv1.PolicyRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	rendered, err := util.RenderRules(util.CompactRules(rules), *o.rulesFormat)
+	if err != nil {
+		return err
+	}
+	fmt.Println("    " + scope + ":")
+	for _, line := range strings.Split(strings.TrimRight(rendered, "\n"), "\n") {
+		fmt.Println("      " + line)
+	}
+	return nil
+}
+
+// snapshot lists the RBAC objects of the cluster selected by --kubeconfig and --context,
+// and the token Secrets with --legacy-token-analysis
+func (o *offlineFlags) snapshot() ([]runtime.Object, error) {
+	restConfig, err := pkg.LoadClientConfig(*o.kubeconfig, *o.kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	objects, err := pkg.SnapshotRBAC(ctx, client)
+	if err != nil || !*o.legacyToken {
+		return objects, err
+	}
+	metadataClient, err := metadata.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	tokenSecrets, err := pkg.SnapshotTokenSecrets(ctx, metadataClient)
+	if err != nil {
+		return nil, err
+	}
+	return append(objects, tokenSecrets...), nil
+}
+
+func printError(err error) int {
+	fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+	return 2
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// apiVersions of the AdmissionReviews the webhook serves
+var (
+	AdmissionReviewV1      = admissionv1.SchemeGroupVersion.String()
+	AdmissionReviewV1beta1 = admissionv1beta1.SchemeGroupVersion.String()
+)
+
+// DecodeAdmissionReview decodes an AdmissionReview of any served apiVersion and returns its request converted to admission/v1
+// and the apiVersion to respond with. Reviews without apiVersion are decoded as v1.
+// The apiVersion is returned with errors as well, so the error can be reported in the version of the request.
+func DecodeAdmissionReview(data []byte) (*admissionv1.AdmissionRequest, string, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return nil, AdmissionReviewV1, err
+	}
+	var request *admissionv1.AdmissionRequest
+	switch typeMeta.APIVersion {
+	case AdmissionReviewV1, "":
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(data, &review); err != nil {
+			return nil, AdmissionReviewV1, err
+		}
+		request = review.Request
+	case AdmissionReviewV1beta1:
+		var review admissionv1beta1.AdmissionReview
+		if err := json.Unmarshal(data, &review); err != nil {
+			return nil, AdmissionReviewV1beta1, err
+		}
+		if review.Request != nil {
+			request = requestFromV1beta1(review.Request)
+		}
+	default:
+		return nil, AdmissionReviewV1, errors.New("AdmissionReview apiVersion " + typeMeta.APIVersion + " is not supported")
+	}
+	apiVersion := typeMeta.APIVersion
+	if apiVersion == "" {
+		apiVersion = AdmissionReviewV1
+	}
+	if request == nil {
+		return nil, apiVersion, errors.New("AdmissionReview contains no request")
+	}
+	return request, apiVersion, nil
+}
+
+// EncodeAdmissionReview returns the AdmissionReview of apiVersion carrying response
+func EncodeAdmissionReview(apiVersion string, response *admissionv1.AdmissionResponse) ([]byte, error) {
+	if apiVersion == AdmissionReviewV1beta1 {
+		return json.Marshal(admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: AdmissionReviewV1beta1, Kind: "AdmissionReview"},
+			Response: responseToV1beta1(response),
+		})
+	}
+	return json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: AdmissionReviewV1, Kind: "AdmissionReview"},
+		Response: response,
+	})
+}
+
+func requestFromV1beta1(request *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:                request.UID,
+		Kind:               request.Kind,
+		Resource:           request.Resource,
+		SubResource:        request.SubResource,
+		RequestKind:        request.RequestKind,
+		RequestResource:    request.RequestResource,
+		RequestSubResource: request.RequestSubResource,
+		Name:               request.Name,
+		Namespace:          request.Namespace,
+		Operation:          admissionv1.Operation(request.Operation),
+		UserInfo:           request.UserInfo,
+		Object:             request.Object,
+		OldObject:          request.OldObject,
+		DryRun:             request.DryRun,
+		Options:            request.Options,
+	}
+}
+
+func responseToV1beta1(response *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	converted := &admissionv1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+	if response.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*response.PatchType)
+		converted.PatchType = &patchType
+	}
+	return converted
+}
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDecodeAdmissionReview(t *testing.T) {
+	request := newTestRequest(t, "builder", "alice")
+	request.Resource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	v1Review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: AdmissionReviewV1, Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1beta1Review, err := json.Marshal(admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: AdmissionReviewV1beta1, Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       request.UID,
+			Kind:      request.Kind,
+			Resource:  request.Resource,
+			Name:      request.Name,
+			Namespace: request.Namespace,
+			Operation: admissionv1beta1.Create,
+			UserInfo:  request.UserInfo,
+			Object:    request.Object,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		apiVersion string
+		// request is the expected request, nil skips the comparison
+		request *admissionv1.AdmissionRequest
+		err     bool
+	}{
+		{name: "v1", data: v1Review, apiVersion: AdmissionReviewV1, request: request},
+		{name: "v1beta1", data: v1beta1Review, apiVersion: AdmissionReviewV1beta1, request: request},
+		{name: "missing apiVersion", data: []byte(`{"request":{"uid":"test-uid"}}`), apiVersion: AdmissionReviewV1, request: &admissionv1.AdmissionRequest{UID: "test-uid"}},
+		{name: "unsupported apiVersion", data: []byte(`{"apiVersion":"admission.k8s.io/v2","request":{}}`), apiVersion: AdmissionReviewV1, err: true},
+		{name: "no request", data: []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`), apiVersion: AdmissionReviewV1beta1, err: true},
+		{name: "malformed", data: []byte(`{`), apiVersion: AdmissionReviewV1, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, apiVersion, err := DecodeAdmissionReview(test.data)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+			if apiVersion != test.apiVersion {
+				t.Errorf("expected apiVersion %s, got %s", test.apiVersion, apiVersion)
+			}
+			if test.request != nil && !reflect.DeepEqual(decoded, test.request) {
+				t.Errorf("expected request %+v, got %+v", test.request, decoded)
+			}
+		})
+	}
+}
+
+func TestEncodeAdmissionReview(t *testing.T) {
+	patchType := admissionv1.PatchTypeJSONPatch
+	response := &admissionv1.AdmissionResponse{
+		UID:       "test-uid",
+		Allowed:   false,
+		Result:    &metav1.Status{Message: "denied", Code: 403},
+		PatchType: &patchType,
+		Warnings:  []string{"warning"},
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		data, err := EncodeAdmissionReview(AdmissionReviewV1, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(data, &review); err != nil {
+			t.Fatal(err)
+		}
+		if review.APIVersion != AdmissionReviewV1 || review.Kind != "AdmissionReview" {
+			t.Errorf("expected TypeMeta of an AdmissionReview, got %+v", review.TypeMeta)
+		}
+		if !reflect.DeepEqual(review.Response, response) {
+			t.Errorf("expected response %+v, got %+v", response, review.Response)
+		}
+	})
+
+	t.Run("v1beta1", func(t *testing.T) {
+		data, err := EncodeAdmissionReview(AdmissionReviewV1beta1, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var review admissionv1beta1.AdmissionReview
+		if err := json.Unmarshal(data, &review); err != nil {
+			t.Fatal(err)
+		}
+		if review.APIVersion != AdmissionReviewV1beta1 || review.Kind != "AdmissionReview" {
+			t.Errorf("expected TypeMeta of an AdmissionReview, got %+v", review.TypeMeta)
+		}
+		expectedPatchType := admissionv1beta1.PatchTypeJSONPatch
+		expected := &admissionv1beta1.AdmissionResponse{
+			UID:       response.UID,
+			Allowed:   response.Allowed,
+			Result:    response.Result,
+			PatchType: &expectedPatchType,
+			Warnings:  response.Warnings,
+		}
+		if !reflect.DeepEqual(review.Response, expected) {
+			t.Errorf("expected response %+v, got %+v", expected, review.Response)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+)
+
+// ValidateBinding validates the creation of a RoleBinding or ClusterRoleBinding and records the metrics of the decision
+func ValidateBinding(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	report := EvaluateBinding(ctx, request, saRbacValidatorConfig)
+	return recordDecision(request, report, start)
+}
+
+// EvaluateBinding compares the permissions a RoleBinding or ClusterRoleBinding grants with the permissions of the requester,
+// if it binds ServiceAccounts the requester can run workloads as. The apiserver admits the binding if the requester holds
+// the permissions of the role or may bind it, so requesters with bind could otherwise gain the permissions through the ServiceAccount.
+func EvaluateBinding(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *Report {
+	logger := saRbacValidatorConfig.Logger.With().Str("Request UID", string(request.UID)).Logger()
+	logger.Info().Msg("Start Validating Binding")
+	report := newReport(request)
+	user := util.ExtractUser(request)
+
+	binding, err := decodeBinding(request)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to decode binding")
+		return report.deny(ReasonInvalidBinding, err.Error())
+	}
+
+	phaseStart := time.Now()
+	_, span := tracer.Start(ctx, "BindingScan", trace.WithAttributes(RequestUIDAttribute(string(request.UID))))
+	userNamespacedRules, err := GetNamespacedPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		observePhase(PhaseBindingScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get namespaced permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	userClusterRules, err := GetClusterPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		observePhase(PhaseBindingScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get cluster permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	report.BoundServiceAccounts, err = runnableServiceAccounts(binding.subjects, binding.namespace, userNamespacedRules, userClusterRules, saRbacValidatorConfig.Source)
+	if err != nil {
+		observePhase(PhaseBindingScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to list namespaces")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	span.SetAttributes(attribute.Int("serviceaccounts.bound", len(report.BoundServiceAccounts)))
+	if len(report.BoundServiceAccounts) == 0 {
+		observePhase(PhaseBindingScan, phaseStart)
+		span.End()
+		logger.Info().Msg("Request allowed")
+		return report.allow(ReasonAllowed, "Binding grants no permissions to ServiceAccounts the requester can run workloads as")
+	}
+	logger.Info().Strs("ServiceAccounts", report.BoundServiceAccounts).Msg("Binding grants permissions to ServiceAccounts the requester can run workloads as")
+
+	rules, err := binding.rules(saRbacValidatorConfig.Source)
+	if apierrors.IsNotFound(err) {
+		// Dangling bindings are valid, the rules a role gains once created are validated by EvaluateRoleUpdate
+		observePhase(PhaseBindingScan, phaseStart)
+		span.End()
+		logger.Info().Str("RoleKind", binding.roleRef.Kind).Str("RoleName", binding.roleRef.Name).Msg("Request allowed, bound role does not exist")
+		return report.allow(ReasonAllowed, binding.roleRef.Kind+" "+binding.roleRef.Name+" does not exist, the binding grants no permissions until it is created")
+	}
+	if err != nil {
+		observePhase(PhaseBindingScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get rules of bound role")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	if binding.namespace == "" {
+		report.ClusterEscalations = util.IsRuleEscalation(userClusterRules, rules)
+	} else {
+		heldRules := append(append([]rbacv1.PolicyRule{}, userNamespacedRules[binding.namespace]...), userClusterRules...)
+		if escalationRules := util.IsRuleEscalation(heldRules, rules); len(escalationRules) > 0 {
+			report.NamespacedEscalations = map[string][]rbacv1.PolicyRule{binding.namespace: escalationRules}
+		}
+	}
+	observePhase(PhaseBindingScan, phaseStart)
+	span.End()
+
+	if report.IsEscalation() {
+		message, err := report.escalationMessage()
+		if err != nil {
+			return report.deny(ReasonRuleRenderingError, err.Error())
+		}
+		logger.Info().Msg("Request denied")
+		return report.deny(ReasonEscalation, message+" The ServiceAccounts "+strings.Join(report.BoundServiceAccounts, ", ")+" can be used by workloads of the requester.")
+	}
+	logger.Info().Msg("Request allowed")
+	return report.allow(ReasonAllowed, "Request allowed")
+}
+
+// binding is the part of a RoleBinding or ClusterRoleBinding the validation depends on.
+// namespace is empty for ClusterRoleBindings.
+type binding struct {
+	namespace string
+	roleRef   rbacv1.RoleRef
+	subjects  []rbacv1.Subject
+}
+
+func decodeBinding(request *admissionv1.AdmissionRequest) (*binding, error) {
+	switch request.Kind.Kind {
+	case "RoleBinding":
+		var roleBinding rbacv1.RoleBinding
+		if err := json.Unmarshal(request.Object.Raw, &roleBinding); err != nil {
+			return nil, errors.New("Failed to decode RoleBinding: " + err.Error())
+		}
+		roleBinding.Namespace = request.Namespace
+		return &binding{namespace: roleBinding.Namespace, roleRef: roleBinding.RoleRef, subjects: roleBinding.Subjects}, nil
+	case "ClusterRoleBinding":
+		var clusterRoleBinding rbacv1.ClusterRoleBinding
+		if err := json.Unmarshal(request.Object.Raw, &clusterRoleBinding); err != nil {
+			return nil, errors.New("Failed to decode ClusterRoleBinding: " + err.Error())
+		}
+		return &binding{roleRef: clusterRoleBinding.RoleRef, subjects: clusterRoleBinding.Subjects}, nil
+	}
+	return nil, errors.New("Kind " + request.Kind.Kind + " is no RoleBinding or ClusterRoleBinding")
+}
+
+// rules returns the rules of the bound Role or ClusterRole
+func (b *binding) rules(source RBACSource) ([]rbacv1.PolicyRule, error) {
+	if b.namespace == "" {
+		return getRulesForClusterRoleBinding(&rbacv1.ClusterRoleBinding{RoleRef: b.roleRef}, source)
+	}
+	roleBinding := &rbacv1.RoleBinding{RoleRef: b.roleRef}
+	roleBinding.Namespace = b.namespace
+	return getRulesForRoleBinding(roleBinding, source)
+}
+
+// runnableServiceAccounts returns the ServiceAccounts of subjects the requester can run workloads as, as namespace/name.
+// The ServiceAccount groups are returned as namespace/* for every namespace the requester can create workloads in.
+func runnableServiceAccounts(subjects []rbacv1.Subject, bindingNamespace string, userNamespacedRules map[string][]rbacv1.PolicyRule, userClusterRules []rbacv1.PolicyRule, source RBACSource) ([]string, error) {
+	clusterRuleSet := util.NewRuleSet(userClusterRules...)
+	canRunIn := func(namespace string) bool {
+		return canCreateWorkloads(util.NewRuleSet(userNamespacedRules[namespace]...).Union(clusterRuleSet))
+	}
+	runnable := make(map[string]bool)
+	for _, subject := range subjects {
+		switch {
+		case subject.Kind == rbacv1.ServiceAccountKind:
+			namespace := subject.Namespace
+			if namespace == "" {
+				namespace = bindingNamespace
+			}
+			if canRunIn(namespace) {
+				runnable[namespace+"/"+subject.Name] = true
+			}
+		case subject.Kind == rbacv1.GroupKind && strings.HasPrefix(subject.Name, serviceaccount.ServiceAccountGroupPrefix):
+			namespace := strings.TrimPrefix(subject.Name, serviceaccount.ServiceAccountGroupPrefix)
+			if canRunIn(namespace) {
+				runnable[namespace+"/*"] = true
+			}
+		case subject.Kind == rbacv1.GroupKind && subject.Name == serviceaccount.AllServiceAccountsGroup:
+			namespaces, err := source.ListNamespaces()
+			if err != nil {
+				return nil, err
+			}
+			for _, namespace := range namespaces {
+				if canRunIn(namespace.Name) {
+					runnable[namespace.Name+"/*"] = true
+				}
+			}
+		}
+	}
+	if len(runnable) == 0 {
+		return nil, nil
+	}
+	return sortedNames(runnable), nil
+}
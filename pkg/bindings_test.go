@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestEvaluateBinding(t *testing.T) {
+	roleBinding := func(role string, subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+		return &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role},
+			Subjects:   subjects,
+		}
+	}
+	serviceAccount := func(name string, namespace string) rbacv1.Subject {
+		return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: namespace}
+	}
+	tests := []struct {
+		name    string
+		object  runtime.Object
+		kind    string
+		allowed bool
+		reason  string
+		bound   []string
+	}{
+		{
+			name:   "binding a role not held by the requester to a usable service account is denied",
+			object: roleBinding("admin", serviceAccount("builder", "")), kind: "RoleBinding",
+			reason: ReasonEscalation, bound: []string{"team/builder"},
+		},
+		{
+			name:   "binding a role held by the requester to a usable service account is allowed",
+			object: roleBinding("pods", serviceAccount("builder", testNamespace)), kind: "RoleBinding",
+			allowed: true, reason: ReasonAllowed, bound: []string{"team/builder"},
+		},
+		{
+			name:   "binding a role to a service account of a namespace without workload permissions is allowed",
+			object: roleBinding("admin", serviceAccount("builder", "other")), kind: "RoleBinding",
+			allowed: true, reason: ReasonAllowed,
+		},
+		{
+			name:   "binding a role to users is allowed",
+			object: roleBinding("admin", rbacv1.Subject{Kind: rbacv1.UserKind, Name: "bob"}), kind: "RoleBinding",
+			allowed: true, reason: ReasonAllowed,
+		},
+		{
+			name: "binding a cluster role not held by the requester to the service account group is denied",
+			object: &rbacv1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "nodes"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts:" + testNamespace}},
+			},
+			kind:   "ClusterRoleBinding",
+			reason: ReasonEscalation, bound: []string{"team/*"},
+		},
+		{
+			name:   "binding a missing role is allowed",
+			object: roleBinding("missing", serviceAccount("builder", "")), kind: "RoleBinding",
+			allowed: true, reason: ReasonAllowed, bound: []string{"team/builder"},
+		},
+		{
+			name:   "other kinds are denied",
+			object: roleBinding("pods"), kind: "Role",
+			reason: ReasonInvalidBinding,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SaRbacValidatorConfig{Logger: zerolog.Nop(), Source: NewMemoryRBACSource(testRBACObjects()...)}
+
+			report := EvaluateBinding(context.Background(), newTestAdmissionRequest(t, rbacv1.SchemeGroupVersion.WithKind(test.kind), test.object, nil), config)
+			if report.Allowed != test.allowed || report.Reason != test.reason {
+				t.Errorf("expected allowed %t with reason %q, got %t with %q: %s", test.allowed, test.reason, report.Allowed, report.Reason, report.Message)
+			}
+			if !reflect.DeepEqual(report.BoundServiceAccounts, test.bound) {
+				t.Errorf("expected bound service accounts %v, got %v", test.bound, report.BoundServiceAccounts)
+			}
+		})
+	}
+}
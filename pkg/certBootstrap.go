@@ -0,0 +1,392 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+
+	caValidity      = 5 * 365 * 24 * time.Hour
+	servingValidity = 90 * 24 * time.Hour
+)
+
+// CertBootstrapper generates a CA and a serving certificate, stores them in a Secret and injects the CA into the
+// caBundle of the ValidatingWebhookConfiguration. Only the leader writes, every replica serves the certificate of the Secret.
+type CertBootstrapper struct {
+	Client              kubernetes.Interface
+	Logger              zerolog.Logger
+	Namespace           string
+	SecretName          string
+	ServiceName         string
+	WebhookConfigName   string
+	Identity            string
+	RenewBefore         time.Duration
+	CheckInterval       time.Duration
+	CertificateProvider *CertificateProvider
+}
+
+// Run blocks until ctx is done. A replica that loses the leader election rejoins it.
+func (b *CertBootstrapper) Run(ctx context.Context) {
+	go b.watchSecret(ctx)
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, b.Namespace, b.SecretName, b.Client.CoreV1(), b.Client.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity: b.Identity,
+	})
+	if err != nil {
+		b.Logger.Error().Err(err).Msg("Failed to create leader election lock")
+		return
+	}
+	config := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				b.Logger.Info().Str("Identity", b.Identity).Msg("Started leading certificate management")
+				b.reconcileLoop(ctx)
+			},
+			OnStoppedLeading: func() {
+				b.Logger.Info().Str("Identity", b.Identity).Msg("Stopped leading certificate management")
+			},
+		},
+	}
+	for {
+		leaderelection.RunOrDie(ctx, config)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// reconcileLoop reconciles every CheckInterval and retries failures with an exponential backoff capped at CheckInterval
+func (b *CertBootstrapper) reconcileLoop(ctx context.Context) {
+	backoff := b.retryBackoff()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		delay := b.CheckInterval
+		if err := b.reconcile(ctx); err != nil {
+			delay = backoff.Step()
+			b.Logger.Error().Err(err).Dur("RetryIn", delay).Msg("Failed to reconcile webhook certificates")
+		} else {
+			backoff = b.retryBackoff()
+		}
+		timer.Reset(delay)
+	}
+}
+
+func (b *CertBootstrapper) retryBackoff() wait.Backoff {
+	return wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: b.CheckInterval}
+}
+
+// watchSecret passes every version of the Secret to the CertificateProvider
+func (b *CertBootstrapper) watchSecret(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(b.Client, 0,
+		informers.WithNamespace(b.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", b.SecretName).String()
+		}))
+	update := func(obj interface{}) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+		if err := b.CertificateProvider.SetCertificate(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+			b.Logger.Error().Err(err).Str("Secret", b.SecretName).Msg("Failed to load certificate from Secret")
+		}
+	}
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+	})
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+}
+
+// reconcile rotates the certificates in two steps so the apiserver never sees a serving certificate it does not trust:
+// a renewed CA is stored and injected into the caBundle next to the old CA first, the serving certificate is only
+// switched to the renewed CA once the injection is confirmed.
+func (b *CertBootstrapper) reconcile(ctx context.Context) error {
+	secret, err := b.Client.CoreV1().Secrets(b.Namespace).Get(ctx, b.SecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.SecretName, Namespace: b.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	data, changed, err := b.renewCA(secret.Data, now)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if secret.ResourceVersion == "" {
+			// Nothing is served yet, the TLS Secret is created with a serving certificate right away
+			if data, _, err = b.renewServingCertificate(data, now); err != nil {
+				return err
+			}
+		}
+		if secret, err = b.storeSecret(ctx, secret, data); err != nil {
+			return err
+		}
+	}
+	if err := b.injectCABundle(ctx, data[caCertKey]); err != nil {
+		return err
+	}
+	if err := b.confirmCABundle(ctx, data[caCertKey]); err != nil {
+		return err
+	}
+
+	data, changed, err = b.renewServingCertificate(data, now)
+	if err != nil || !changed {
+		return err
+	}
+	_, err = b.storeSecret(ctx, secret, data)
+	return err
+}
+
+func (b *CertBootstrapper) storeSecret(ctx context.Context, secret *corev1.Secret, data map[string][]byte) (*corev1.Secret, error) {
+	secret = secret.DeepCopy()
+	secret.Data = data
+	var err error
+	if secret.ResourceVersion == "" {
+		secret, err = b.Client.CoreV1().Secrets(b.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret, err = b.Client.CoreV1().Secrets(b.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.Logger.Info().Str("Secret", b.SecretName).Msg("Stored renewed webhook certificates")
+	return secret, nil
+}
+
+// renewCA returns the Secret data with a CA that is valid for longer than RenewBefore plus the validity of a serving certificate.
+// A renewed CA is prepended to the bundle, expired CAs are removed from it. The serving certificate is kept, so clients
+// keep trusting it until the renewed CA is injected.
+func (b *CertBootstrapper) renewCA(data map[string][]byte, now time.Time) (map[string][]byte, bool, error) {
+	caBundle := validCertificates(data[caCertKey], now)
+	caCert, _, caErr := parseCertificateAndKey(firstPEMBlock(data[caCertKey]), data[caKeyKey])
+	caKeyPEM := data[caKeyKey]
+	if caErr != nil || caCert.NotAfter.Sub(now) < b.RenewBefore+servingValidity {
+		b.Logger.Info().Msg("Generating webhook CA")
+		newCAPEM, newCAKeyPEM, err := generateCA(now)
+		if err != nil {
+			return nil, false, err
+		}
+		caBundle = append(newCAPEM, caBundle...)
+		caKeyPEM = newCAKeyPEM
+	} else if bytes.Equal(caBundle, data[caCertKey]) {
+		return data, false, nil
+	}
+	return map[string][]byte{
+		caCertKey:               caBundle,
+		caKeyKey:                caKeyPEM,
+		corev1.TLSCertKey:       data[corev1.TLSCertKey],
+		corev1.TLSPrivateKeyKey: data[corev1.TLSPrivateKeyKey],
+	}, true, nil
+}
+
+// renewServingCertificate returns the Secret data with a serving certificate signed by the first CA of the bundle
+// that is valid for longer than RenewBefore
+func (b *CertBootstrapper) renewServingCertificate(data map[string][]byte, now time.Time) (map[string][]byte, bool, error) {
+	caCert, caKey, err := parseCertificateAndKey(firstPEMBlock(data[caCertKey]), data[caKeyKey])
+	if err != nil {
+		return nil, false, err
+	}
+	servingCert, _, servingErr := parseCertificateAndKey(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if servingErr == nil && servingCert.NotAfter.Sub(now) >= b.RenewBefore && servingCert.CheckSignatureFrom(caCert) == nil {
+		return data, false, nil
+	}
+	b.Logger.Info().Msg("Generating webhook serving certificate")
+	certPEM, keyPEM, err := generateServingCertificate(now, caCert, caKey, b.dnsNames())
+	if err != nil {
+		return nil, false, err
+	}
+	return map[string][]byte{
+		caCertKey:               data[caCertKey],
+		caKeyKey:                data[caKeyKey],
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}, true, nil
+}
+
+func (b *CertBootstrapper) dnsNames() []string {
+	return []string{
+		b.ServiceName,
+		b.ServiceName + "." + b.Namespace,
+		b.ServiceName + "." + b.Namespace + ".svc",
+		b.ServiceName + "." + b.Namespace + ".svc.cluster.local",
+	}
+}
+
+func (b *CertBootstrapper) injectCABundle(ctx context.Context, caBundle []byte) error {
+	webhookConfig, err := b.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, b.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for index := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[index].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[index].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = b.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, webhookConfig, metav1.UpdateOptions{})
+	if err == nil {
+		b.Logger.Info().Str("ValidatingWebhookConfiguration", b.WebhookConfigName).Msg("Injected caBundle")
+	}
+	return err
+}
+
+// confirmCABundle reads the ValidatingWebhookConfiguration back and fails unless every webhook trusts caBundle
+func (b *CertBootstrapper) confirmCABundle(ctx context.Context, caBundle []byte) error {
+	webhookConfig, err := b.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, b.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, caBundle) {
+			return errors.New("caBundle of webhook " + webhook.Name + " in ValidatingWebhookConfiguration " + b.WebhookConfigName + " is not up to date")
+		}
+	}
+	return nil
+}
+
+func generateCA(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "sa-rbac-validator-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return signCertificate(template, template, key, key)
+}
+
+func generateServingCertificate(now time.Time, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(servingValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return signCertificate(template, caCert, key, caKey)
+}
+
+func signCertificate(template *x509.Certificate, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+func randomSerialNumber() *big.Int {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serialNumber
+}
+
+func parseCertificateAndKey(certPEM []byte, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, errors.New("No certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("No private key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func firstPEMBlock(data []byte) []byte {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// validCertificates returns the PEM encoded certificates of bundle which are not expired yet
+func validCertificates(bundle []byte, now time.Time) []byte {
+	var result []byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return result
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || now.After(cert.NotAfter) {
+			continue
+		}
+		result = append(result, pem.EncodeToMemory(block)...)
+	}
+}
@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestBootstrapper(client *fake.Clientset) *CertBootstrapper {
+	return &CertBootstrapper{
+		Client:            client,
+		Logger:            zerolog.Nop(),
+		Namespace:         "webhook",
+		SecretName:        "certs",
+		ServiceName:       "sa-rbac-validator",
+		WebhookConfigName: "sa-rbac-validator",
+		RenewBefore:       30 * 24 * time.Hour,
+		CheckInterval:     time.Hour,
+	}
+}
+
+func testWebhookConfig() *admissionregistrationv1.ValidatingWebhookConfiguration {
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "sa-rbac-validator"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "workloads.sa-rbac-validator"}, {Name: "rbac.sa-rbac-validator"}},
+	}
+}
+
+// testCertificateData returns Secret data with a CA created at caCreated and a serving certificate signed by it
+func testCertificateData(t *testing.T, b *CertBootstrapper, caCreated time.Time) map[string][]byte {
+	t.Helper()
+	caPEM, caKeyPEM, err := generateCA(caCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, caKey, err := parseCertificateAndKey(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := generateServingCertificate(time.Now(), caCert, caKey, b.dnsNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{caCertKey: caPEM, caKeyKey: caKeyPEM, corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM}
+}
+
+func countCertificates(bundle []byte) int {
+	count := 0
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		count++
+	}
+	return count
+}
+
+// verifyServingCertificate fails unless the serving certificate of data is trusted by caBundle for the service of b at now
+func verifyServingCertificate(t *testing.T, b *CertBootstrapper, data map[string][]byte, caBundle []byte, now time.Time) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		t.Fatal("expected certificates in the caBundle")
+	}
+	cert, _, err := parseCertificateAndKey(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: b.ServiceName + "." + b.Namespace + ".svc", CurrentTime: now}); err != nil {
+		t.Errorf("expected the serving certificate to be trusted by the caBundle, got %v", err)
+	}
+}
+
+func TestRenewCA(t *testing.T) {
+	b := newTestBootstrapper(fake.NewSimpleClientset())
+	now := time.Now()
+	valid := testCertificateData(t, b, now)
+	expiring := testCertificateData(t, b, now.Add(-caValidity+60*24*time.Hour))
+	expired := testCertificateData(t, b, now.Add(-caValidity-24*time.Hour))
+	withExpired := testCertificateData(t, b, now)
+	withExpired[caCertKey] = append(append([]byte{}, withExpired[caCertKey]...), expired[caCertKey]...)
+
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		changed bool
+		// renewed is true if a new CA is expected in front of the bundle
+		renewed      bool
+		certificates int
+	}{
+		{name: "empty", data: nil, changed: true, renewed: true, certificates: 1},
+		{name: "valid", data: valid, certificates: 1},
+		{name: "expiring", data: expiring, changed: true, renewed: true, certificates: 2},
+		{name: "expired CA in bundle", data: withExpired, changed: true, certificates: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, changed, err := b.renewCA(test.data, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.changed {
+				t.Errorf("expected changed %t, got %t", test.changed, changed)
+			}
+			if count := countCertificates(data[caCertKey]); count != test.certificates {
+				t.Errorf("expected %d certificates in the bundle, got %d", test.certificates, count)
+			}
+			renewed := !bytes.Equal(firstPEMBlock(data[caCertKey]), firstPEMBlock(test.data[caCertKey]))
+			if renewed != test.renewed {
+				t.Errorf("expected renewed CA %t, got %t", test.renewed, renewed)
+			}
+			if _, _, err := parseCertificateAndKey(firstPEMBlock(data[caCertKey]), data[caKeyKey]); err != nil {
+				t.Errorf("expected the key of the first CA of the bundle, got %v", err)
+			}
+			if !bytes.Equal(data[corev1.TLSCertKey], test.data[corev1.TLSCertKey]) {
+				t.Error("expected the serving certificate to be kept")
+			}
+		})
+	}
+}
+
+func TestRenewServingCertificate(t *testing.T) {
+	b := newTestBootstrapper(fake.NewSimpleClientset())
+	now := time.Now()
+	valid := testCertificateData(t, b, now)
+	otherCA := testCertificateData(t, b, now)
+	otherCA[corev1.TLSCertKey], otherCA[corev1.TLSPrivateKeyKey] = valid[corev1.TLSCertKey], valid[corev1.TLSPrivateKeyKey]
+	noServingCertificate := testCertificateData(t, b, now)
+	delete(noServingCertificate, corev1.TLSCertKey)
+
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		now     time.Time
+		changed bool
+	}{
+		{name: "valid", data: valid, now: now},
+		{name: "expiring", data: valid, now: now.Add(servingValidity - 10*24*time.Hour), changed: true},
+		{name: "signed by another CA", data: otherCA, now: now, changed: true},
+		{name: "missing", data: noServingCertificate, now: now, changed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, changed, err := b.renewServingCertificate(test.data, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.changed {
+				t.Errorf("expected changed %t, got %t", test.changed, changed)
+			}
+			if !bytes.Equal(data[caCertKey], test.data[caCertKey]) || !bytes.Equal(data[caKeyKey], test.data[caKeyKey]) {
+				t.Error("expected the CA to be kept")
+			}
+			verifyServingCertificate(t, b, data, firstPEMBlock(data[caCertKey]), test.now)
+		})
+	}
+}
+
+func TestValidCertificates(t *testing.T) {
+	b := newTestBootstrapper(fake.NewSimpleClientset())
+	now := time.Now()
+	first := testCertificateData(t, b, now)[caCertKey]
+	second := testCertificateData(t, b, now.Add(-time.Hour))[caCertKey]
+	expired := testCertificateData(t, b, now.Add(-caValidity-time.Hour))[caCertKey]
+	invalid := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})
+
+	bundle := bytes.Join([][]byte{first, expired, invalid, second}, nil)
+	expected := append(append([]byte{}, first...), second...)
+	if result := validCertificates(bundle, now); !bytes.Equal(result, expected) {
+		t.Errorf("expected %d valid certificates in order, got %d certificates", 2, countCertificates(result))
+	}
+}
+
+func TestReconcileBootstrap(t *testing.T) {
+	client := fake.NewSimpleClientset(testWebhookConfig())
+	b := newTestBootstrapper(client)
+	if err := b.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets(b.Namespace).Get(context.Background(), b.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("expected Secret type %s, got %s", corev1.SecretTypeTLS, secret.Type)
+	}
+	webhookConfig, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), b.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, secret.Data[caCertKey]) {
+			t.Errorf("expected the caBundle of the Secret in webhook %s", webhook.Name)
+		}
+	}
+	verifyServingCertificate(t, b, secret.Data, secret.Data[caCertKey], time.Now())
+
+	// A second reconcile keeps the certificates
+	if err := b.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	unchanged, err := client.CoreV1().Secrets(b.Namespace).Get(context.Background(), b.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.ResourceVersion != secret.ResourceVersion || !bytes.Equal(unchanged.Data[corev1.TLSCertKey], secret.Data[corev1.TLSCertKey]) {
+		t.Error("expected the Secret to be unchanged")
+	}
+}
+
+func TestReconcileRotatesCAFirst(t *testing.T) {
+	b := newTestBootstrapper(fake.NewSimpleClientset())
+	data := testCertificateData(t, b, time.Now().Add(-caValidity+60*24*time.Hour))
+	webhookConfig := testWebhookConfig()
+	for index := range webhookConfig.Webhooks {
+		webhookConfig.Webhooks[index].ClientConfig.CABundle = data[caCertKey]
+	}
+	client := fake.NewSimpleClientset(webhookConfig, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: b.SecretName, Namespace: b.Namespace, ResourceVersion: "1"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       data,
+	})
+	failInjection := true
+	client.PrependReactor("update", "validatingwebhookconfigurations", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failInjection {
+			return true, nil, errors.New("injection failed")
+		}
+		return false, nil, nil
+	})
+	b.Client = client
+
+	if err := b.reconcile(context.Background()); err == nil {
+		t.Fatal("expected the failed injection to be returned")
+	}
+	secret, err := client.CoreV1().Secrets(b.Namespace).Get(context.Background(), b.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countCertificates(secret.Data[caCertKey]); count != 2 {
+		t.Errorf("expected the renewed and the old CA in the bundle, got %d certificates", count)
+	}
+	if !bytes.Equal(secret.Data[corev1.TLSCertKey], data[corev1.TLSCertKey]) {
+		t.Error("expected the serving certificate to be kept until the caBundle is injected")
+	}
+
+	failInjection = false
+	if err := b.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := client.CoreV1().Secrets(b.Namespace).Get(context.Background(), b.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rotated.Data[caCertKey], secret.Data[caCertKey]) {
+		t.Error("expected the bundle of the first reconcile to be kept")
+	}
+	if bytes.Equal(rotated.Data[corev1.TLSCertKey], data[corev1.TLSCertKey]) {
+		t.Error("expected the serving certificate to be renewed after the caBundle is injected")
+	}
+	verifyServingCertificate(t, b, rotated.Data, firstPEMBlock(rotated.Data[caCertKey]), time.Now())
+	webhookConfig, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), b.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, rotated.Data[caCertKey]) {
+			t.Errorf("expected the renewed caBundle in webhook %s", webhook.Name)
+		}
+	}
+}
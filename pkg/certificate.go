@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "sa_rbac_validator",
+	Name:      "certificate_expiry_timestamp_seconds",
+	Help:      "Unix timestamp at which the currently served certificate expires.",
+})
+
+// CertificateProvider serves the certificate for the tls listener and reloads it when the files changed.
+// A failed reload is logged and the previous certificate is kept.
+type CertificateProvider struct {
+	certFile      string
+	keyFile       string
+	interval      time.Duration
+	expiryWarning time.Duration
+	logger        zerolog.Logger
+	certificate   atomic.Pointer[tls.Certificate]
+	// mutex guards the fields below
+	mutex       sync.Mutex
+	lastCert    []byte
+	lastKey     []byte
+	lastWarning time.Time
+}
+
+// NewCertificateProvider loads the initial certificate from certFile and keyFile
+func NewCertificateProvider(certFile string, keyFile string, interval time.Duration, expiryWarning time.Duration, logger zerolog.Logger) (*CertificateProvider, error) {
+	provider := &CertificateProvider{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		interval:      interval,
+		expiryWarning: expiryWarning,
+		logger:        logger,
+	}
+	if err := provider.load(); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (p *CertificateProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate := p.certificate.Load()
+	if certificate == nil {
+		return nil, errors.New("No certificate loaded")
+	}
+	return certificate, nil
+}
+
+// Ready reports if a certificate is loaded
+func (p *CertificateProvider) Ready() bool {
+	return p.certificate.Load() != nil
+}
+
+func (p *CertificateProvider) Run(stopper <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopper:
+			return
+		case <-ticker.C:
+			if err := p.load(); err != nil {
+				p.logger.Error().Err(err).Str("CertFile", p.certFile).Msg("Failed to reload certificate, keeping previous certificate")
+			}
+			p.mutex.Lock()
+			p.checkExpiry()
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// SetCertificate replaces the served certificate with the PEM encoded certificate and key
+func (p *CertificateProvider) SetCertificate(certPEM []byte, keyPEM []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if bytes.Equal(certPEM, p.lastCert) && bytes.Equal(keyPEM, p.lastKey) {
+		return nil
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	certificate.Leaf = leaf
+	p.lastCert = certPEM
+	p.lastKey = keyPEM
+	if p.certificate.Swap(&certificate) != nil {
+		p.logger.Info().Time("NotAfter", leaf.NotAfter).Msg("Certificate reloaded")
+	}
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	p.checkExpiry()
+	return nil
+}
+
+func (p *CertificateProvider) load() error {
+	if p.certFile == "" {
+		return nil
+	}
+	certPEM, err := os.ReadFile(p.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(p.keyFile)
+	if err != nil {
+		return err
+	}
+	return p.SetCertificate(certPEM, keyPEM)
+}
+
+// checkExpiry must be called with the mutex held. It logs a warning at most once per hour if the certificate expires within the warning period
+func (p *CertificateProvider) checkExpiry() {
+	certificate := p.certificate.Load()
+	if certificate == nil || time.Until(certificate.Leaf.NotAfter) > p.expiryWarning || time.Since(p.lastWarning) < time.Hour {
+		return
+	}
+	p.lastWarning = time.Now()
+	p.logger.Warn().Time("NotAfter", certificate.Leaf.NotAfter).Msg("Certificate expires soon")
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+// testCertificatePair returns a serving certificate signed by a new CA and its key, expiring servingValidity after created
+func testCertificatePair(t *testing.T, created time.Time) ([]byte, []byte) {
+	t.Helper()
+	caPEM, caKeyPEM, err := generateCA(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, caKey, err := parseCertificateAndKey(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := generateServingCertificate(created, caCert, caKey, []string{"sa-rbac-validator", "sa-rbac-validator.webhook.svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestCertificateProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writePair := func(t *testing.T, certPEM []byte, keyPEM []byte) {
+		t.Helper()
+		if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	initialCert, initialKey := testCertificatePair(t, now)
+	writePair(t, initialCert, initialKey)
+
+	provider, err := NewCertificateProvider(certFile, keyFile, time.Minute, time.Hour, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewedCert, renewedKey := testCertificatePair(t, now.Add(24*time.Hour))
+	otherCert, _ := testCertificatePair(t, now.Add(48*time.Hour))
+
+	tests := []struct {
+		name    string
+		certPEM []byte
+		keyPEM  []byte
+		err     bool
+		// notAfter is the expiry of the served certificate after the reload
+		notAfter time.Time
+	}{
+		{name: "unchanged pair keeps the certificate", certPEM: initialCert, keyPEM: initialKey, notAfter: now.Add(servingValidity)},
+		{name: "changed pair is served", certPEM: renewedCert, keyPEM: renewedKey, notAfter: now.Add(24*time.Hour + servingValidity)},
+		{name: "mismatched key keeps the previous certificate", certPEM: otherCert, keyPEM: renewedKey, err: true, notAfter: now.Add(24*time.Hour + servingValidity)},
+		{name: "malformed pair keeps the previous certificate", certPEM: []byte("malformed"), keyPEM: []byte("malformed"), err: true, notAfter: now.Add(24*time.Hour + servingValidity)},
+		{name: "valid pair after a failed reload is served", certPEM: initialCert, keyPEM: initialKey, notAfter: now.Add(servingValidity)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writePair(t, test.certPEM, test.keyPEM)
+
+			err := provider.load()
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+			certificate, err := provider.GetCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !certificate.Leaf.NotAfter.Equal(test.notAfter) {
+				t.Errorf("expected served certificate expiring at %s, got %s", test.notAfter, certificate.Leaf.NotAfter)
+			}
+			if expiry := testutil.ToFloat64(certificateExpiry); expiry != float64(test.notAfter.Unix()) {
+				t.Errorf("expected certificate_expiry_timestamp_seconds %d, got %f", test.notAfter.Unix(), expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsonpointer "github.com/go-openapi/jsonpointer"
+	"github.com/rs/zerolog"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the file representation of the runtime settings. It can be written as YAML or JSON.
+// Options that start informers, like LegacyTokenAnalysis, are only read at boot and are no part of it.
+type Config struct {
+	LogLevel                  string `json:"logLevel,omitempty"`
+	ServiceAccountJsonPointer string `json:"serviceAccountJsonPointer,omitempty"`
+	SaNotFoundBehavior        string `json:"saNotFoundBehavior,omitempty"`
+	// CriticalPermissionBehavior decides about ServiceAccounts holding escalate, bind or impersonate: allow or deny
+	CriticalPermissionBehavior string `json:"criticalPermissionBehavior,omitempty"`
+	// CriticalPermissionExemptions are the requesters that may create workloads with critical ServiceAccounts if they hold the same permissions
+	CriticalPermissionExemptions *CriticalPermissionExemptions `json:"criticalPermissionExemptions,omitempty"`
+	// TransitiveAnalysis adds the permissions of all ServiceAccounts the ServiceAccount can act as through tokens, workloads or Secrets
+	TransitiveAnalysis *bool `json:"transitiveAnalysis,omitempty"`
+}
+
+// CriticalPermissionExemptions are requesters by user name and group
+type CriticalPermissionExemptions struct {
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// exempts reports if the requester is exempted by name or by any of its groups
+func (e CriticalPermissionExemptions) exempts(requester user.Info) bool {
+	for _, name := range e.Users {
+		if name == requester.GetName() {
+			return true
+		}
+	}
+	for _, group := range e.Groups {
+		for _, requesterGroup := range requester.GetGroups() {
+			if group == requesterGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Settings are the validated runtime settings which are applied to the SaRbacValidatorConfig of every request
+type Settings struct {
+	LogLevel                     zerolog.Level
+	ServiceAccountJsonPointer    string
+	SaNotFoundBehavior           int
+	DenyCriticalPermissions      bool
+	CriticalPermissionExemptions CriticalPermissionExemptions
+	TransitiveAnalysis           bool
+}
+
+func ParseConfig(data []byte) (Config, error) {
+	var config Config
+	err := yaml.UnmarshalStrict(data, &config)
+	return config, err
+}
+
+// WithOverrides returns a copy of c with all non empty values of overrides applied.
+// Command line flags and environment variables are passed as overrides and take precedence over the config file.
+func (c Config) WithOverrides(overrides Config) Config {
+	if overrides.LogLevel != "" {
+		c.LogLevel = overrides.LogLevel
+	}
+	if overrides.ServiceAccountJsonPointer != "" {
+		c.ServiceAccountJsonPointer = overrides.ServiceAccountJsonPointer
+	}
+	if overrides.SaNotFoundBehavior != "" {
+		c.SaNotFoundBehavior = overrides.SaNotFoundBehavior
+	}
+	if overrides.CriticalPermissionBehavior != "" {
+		c.CriticalPermissionBehavior = overrides.CriticalPermissionBehavior
+	}
+	if overrides.CriticalPermissionExemptions != nil {
+		c.CriticalPermissionExemptions = overrides.CriticalPermissionExemptions
+	}
+	if overrides.TransitiveAnalysis != nil {
+		c.TransitiveAnalysis = overrides.TransitiveAnalysis
+	}
+	return c
+}
+
+func (c Config) Validate() (*Settings, error) {
+	var settings Settings
+	var errs []string
+
+	settings.LogLevel = zerolog.InfoLevel
+	if c.LogLevel != "" {
+		logLevel, err := zerolog.ParseLevel(c.LogLevel)
+		if err != nil || logLevel == zerolog.NoLevel {
+			errs = append(errs, "logLevel: "+c.LogLevel+" invalid")
+		} else {
+			settings.LogLevel = logLevel
+		}
+	}
+
+	if _, err := jsonpointer.New(c.ServiceAccountJsonPointer); err != nil {
+		errs = append(errs, "serviceAccountJsonPointer: "+err.Error())
+	}
+	settings.ServiceAccountJsonPointer = c.ServiceAccountJsonPointer
+
+	saNotFoundBehavior, err := parseBehavior("saNotFoundBehavior", c.SaNotFoundBehavior)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	settings.SaNotFoundBehavior = saNotFoundBehavior
+
+	if c.CriticalPermissionBehavior != "" {
+		criticalPermissionBehavior, err := parseBehavior("criticalPermissionBehavior", c.CriticalPermissionBehavior)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		settings.DenyCriticalPermissions = criticalPermissionBehavior == Deny
+	}
+	if c.CriticalPermissionExemptions != nil {
+		settings.CriticalPermissionExemptions = *c.CriticalPermissionExemptions
+	}
+	if c.TransitiveAnalysis != nil {
+		settings.TransitiveAnalysis = *c.TransitiveAnalysis
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New("Invalid config: " + strings.Join(errs, ", "))
+	}
+	return &settings, nil
+}
+
+// parseBehavior parses the deny or allow value of the behavior setting name
+func parseBehavior(name string, value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "deny":
+		return Deny, nil
+	case "allow":
+		return Allow, nil
+	}
+	return -1, errors.New(name + ": " + value + " invalid, expected deny or allow")
+}
+
+// Apply returns a copy of saRbacValidatorConfig with the settings applied
+func (s *Settings) Apply(saRbacValidatorConfig SaRbacValidatorConfig) SaRbacValidatorConfig {
+	saRbacValidatorConfig.Logger = saRbacValidatorConfig.Logger.Level(s.LogLevel)
+	saRbacValidatorConfig.ServiceAccountJsonPointer = s.ServiceAccountJsonPointer
+	saRbacValidatorConfig.SaNotFoundBehavior = s.SaNotFoundBehavior
+	saRbacValidatorConfig.DenyCriticalPermissions = s.DenyCriticalPermissions
+	saRbacValidatorConfig.CriticalPermissionExemptions = s.CriticalPermissionExemptions
+	saRbacValidatorConfig.TransitiveAnalysis = s.TransitiveAnalysis
+	return saRbacValidatorConfig
+}
+
+// ConfigLoader polls the config file and atomically swaps the settings when the content changed.
+// Invalid configs are logged and the previous settings are retained.
+type ConfigLoader struct {
+	path        string
+	interval    time.Duration
+	overrides   Config
+	logger      zerolog.Logger
+	settings    atomic.Pointer[Settings]
+	lastContent []byte
+	// lastContentValid is only accessed by the polling goroutine
+	lastContentValid bool
+	lastLoadOk       atomic.Bool
+}
+
+// NewConfigLoader loads the initial settings. If path is empty only the overrides are used.
+func NewConfigLoader(path string, interval time.Duration, overrides Config, logger zerolog.Logger) (*ConfigLoader, error) {
+	loader := &ConfigLoader{
+		path:      path,
+		interval:  interval,
+		overrides: overrides,
+		logger:    logger,
+	}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+func (c *ConfigLoader) Current() *Settings {
+	return c.settings.Load()
+}
+
+// LastLoadSucceeded reports if the most recent attempt to load the config file was successful
+func (c *ConfigLoader) LastLoadSucceeded() bool {
+	return c.lastLoadOk.Load()
+}
+
+func (c *ConfigLoader) Run(stopper <-chan struct{}) {
+	if c.path == "" {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopper:
+			return
+		case <-ticker.C:
+			if err := c.load(); err != nil {
+				c.logger.Error().Err(err).Str("Path", c.path).Msg("Failed to reload config, keeping previous config")
+			}
+		}
+	}
+}
+
+func (c *ConfigLoader) load() error {
+	var config Config
+	if c.path != "" {
+		data, err := os.ReadFile(c.path)
+		if err != nil {
+			c.lastLoadOk.Store(false)
+			return err
+		}
+		// Unchanged content was already validated, invalid content is only reported once
+		if c.settings.Load() != nil && bytes.Equal(data, c.lastContent) {
+			c.lastLoadOk.Store(c.lastContentValid)
+			return nil
+		}
+		c.lastContent = data
+		c.lastContentValid = false
+		config, err = ParseConfig(data)
+		if err != nil {
+			c.lastLoadOk.Store(false)
+			return err
+		}
+	}
+	settings, err := config.WithOverrides(c.overrides).Validate()
+	if err != nil {
+		c.lastLoadOk.Store(false)
+		return err
+	}
+	c.lastContentValid = true
+	if c.settings.Swap(settings) != nil {
+		c.logger.Info().Str("Path", c.path).Msg("Config reloaded")
+	}
+	c.lastLoadOk.Store(true)
+	return nil
+}
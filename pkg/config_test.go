@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestConfigLoader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(t *testing.T, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(t, "logLevel: debug\nserviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehavior: deny\n")
+	transitiveAnalysis := true
+	overrides := Config{LogLevel: "warn", TransitiveAnalysis: &transitiveAnalysis}
+
+	loader, err := NewConfigLoader(path, time.Minute, overrides, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loader.LastLoadSucceeded() {
+		t.Errorf("expected initial load to succeed")
+	}
+	initial := loader.Current()
+	if initial.SaNotFoundBehavior != Deny || initial.ServiceAccountJsonPointer != "/spec/serviceAccountName" {
+		t.Errorf("expected settings of the config file, got %+v", initial)
+	}
+	if initial.LogLevel != zerolog.WarnLevel || !initial.TransitiveAnalysis {
+		t.Errorf("expected overrides to take precedence over the config file, got %+v", initial)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		err     bool
+		// swapped reports if the settings are replaced, otherwise the previous settings are expected
+		swapped            bool
+		saNotFoundBehavior int
+	}{
+		{
+			name:    "changed config is swapped",
+			content: "logLevel: debug\nserviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehavior: allow\n",
+			swapped: true, saNotFoundBehavior: Allow,
+		},
+		{
+			name:               "unchanged config keeps the settings",
+			content:            "logLevel: debug\nserviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehavior: allow\n",
+			saNotFoundBehavior: Allow,
+		},
+		{
+			name:    "invalid yaml keeps the previous settings",
+			content: "saNotFoundBehavior: [deny\n",
+			err:     true, saNotFoundBehavior: Allow,
+		},
+		{
+			name:    "unknown field keeps the previous settings",
+			content: "serviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehaviour: deny\n",
+			err:     true, saNotFoundBehavior: Allow,
+		},
+		{
+			name:    "invalid value keeps the previous settings",
+			content: "serviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehavior: ignore\n",
+			err:     true, saNotFoundBehavior: Allow,
+		},
+		{
+			name:    "invalid value overridden by a flag is swapped",
+			content: "logLevel: loud\nserviceAccountJsonPointer: /spec/serviceAccountName\nsaNotFoundBehavior: deny\n",
+			swapped: true, saNotFoundBehavior: Deny,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := loader.Current()
+			writeConfig(t, test.content)
+
+			err := loader.load()
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+			if loader.LastLoadSucceeded() != !test.err {
+				t.Errorf("expected last load succeeded %t, got %t", !test.err, loader.LastLoadSucceeded())
+			}
+			current := loader.Current()
+			if (current != previous) != test.swapped {
+				t.Errorf("expected settings swapped %t, got %t", test.swapped, current != previous)
+			}
+			if current.SaNotFoundBehavior != test.saNotFoundBehavior {
+				t.Errorf("expected saNotFoundBehavior %d, got %d", test.saNotFoundBehavior, current.SaNotFoundBehavior)
+			}
+			if current.LogLevel != zerolog.WarnLevel || !current.TransitiveAnalysis {
+				t.Errorf("expected overrides to take precedence over the config file, got %+v", current)
+			}
+		})
+	}
+
+	t.Run("unchanged invalid config is still reported as failed", func(t *testing.T) {
+		writeConfig(t, "saNotFoundBehavior: [deny\n")
+		if err := loader.load(); err == nil {
+			t.Fatal("expected error for invalid yaml")
+		}
+		if err := loader.load(); err != nil {
+			t.Fatalf("expected unchanged content to be skipped, got %v", err)
+		}
+		if loader.LastLoadSucceeded() {
+			t.Error("expected last load to be reported as failed")
+		}
+	})
+
+	t.Run("missing file keeps the previous settings", func(t *testing.T) {
+		previous := loader.Current()
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := loader.load(); err == nil {
+			t.Fatal("expected error for missing file")
+		}
+		if loader.LastLoadSucceeded() || loader.Current() != previous {
+			t.Error("expected previous settings and a failed load")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"net/http"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// Healthz reports that the process is able to serve http requests
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// ReadinessChecker reports ready once all informer caches are synced, the last config load succeeded and a certificate is loaded.
+// CertificateProvider is nil when serving plain http.
+type ReadinessChecker struct {
+	InformersSynced     []cache.InformerSynced
+	ConfigLoader        *ConfigLoader
+	CertificateProvider *CertificateProvider
+}
+
+func (c *ReadinessChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, informerSynced := range c.InformersSynced {
+		if !informerSynced() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("informer caches not synced"))
+			return
+		}
+	}
+	if !c.ConfigLoader.LastLoadSucceeded() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("last config load failed"))
+		return
+	}
+	if c.CertificateProvider != nil && !c.CertificateProvider.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("no certificate loaded"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// LoadClientConfig returns the in-cluster config if neither kubeconfig nor context are set and the process runs in a pod.
+// Otherwise the kubeconfig is loaded with the same precedence as kubectl (explicit path, KUBECONFIG, ~/.kube/config).
+func LoadClientConfig(kubeconfig string, context string) (*rest.Config, error) {
+	if kubeconfig == "" && context == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, nil
+		}
+		if err != rest.ErrNotInCluster {
+			return nil, err
+		}
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"sort"
+	"sync"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/tools/cache"
+)
+
+// MemoryRBACSource serves RBAC objects held in memory, e.g. decoded from static manifests or built as test fixtures.
+// ServiceAccounts are resolved without any API call.
+type MemoryRBACSource struct {
+	mutex               sync.RWMutex
+	namespaces          map[string]*corev1.Namespace
+	roles               map[string]map[string]*rbacv1.Role
+	roleBindings        cache.Indexer
+	clusterRoles        map[string]*rbacv1.ClusterRole
+	clusterRoleBindings cache.Indexer
+	tokenSecrets        cache.Indexer
+	pods                cache.Indexer
+}
+
+// NewMemoryRBACSource returns a MemoryRBACSource serving objects
+func NewMemoryRBACSource(objects ...runtime.Object) *MemoryRBACSource {
+	source := &MemoryRBACSource{
+		namespaces:          make(map[string]*corev1.Namespace),
+		roles:               make(map[string]map[string]*rbacv1.Role),
+		roleBindings:        cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		clusterRoles:        make(map[string]*rbacv1.ClusterRole),
+		clusterRoleBindings: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		tokenSecrets:        cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		pods:                cache.NewIndexer(cache.MetaNamespaceKeyFunc, podIndexers),
+	}
+	// Adding the indexers to empty indexers can not fail
+	_ = source.roleBindings.AddIndexers(roleBindingIndexers)
+	_ = source.clusterRoleBindings.AddIndexers(clusterRoleBindingIndexers)
+	source.Add(objects...)
+	return source
+}
+
+// Add adds or replaces Namespaces, Roles, RoleBindings, ClusterRoles, ClusterRoleBindings, the metadata of
+// ServiceAccount token Secrets and the ServiceAccounts of Pods, other kinds are ignored.
+// Namespaces referenced by Roles or RoleBindings are created if missing.
+func (s *MemoryRBACSource) Add(objects ...runtime.Object) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, object := range objects {
+		switch typed := object.(type) {
+		case *corev1.Namespace:
+			s.namespaces[typed.Name] = typed
+		case *rbacv1.Role:
+			s.referenceNamespace(typed.Namespace)
+			if s.roles[typed.Namespace] == nil {
+				s.roles[typed.Namespace] = make(map[string]*rbacv1.Role)
+			}
+			s.roles[typed.Namespace][typed.Name] = typed
+		case *rbacv1.RoleBinding:
+			s.referenceNamespace(typed.Namespace)
+			_ = s.roleBindings.Update(typed)
+		case *rbacv1.ClusterRole:
+			s.clusterRoles[typed.Name] = typed
+		case *rbacv1.ClusterRoleBinding:
+			_ = s.clusterRoleBindings.Update(typed)
+		case *corev1.Secret:
+			if secret, ok := tokenSecretMetadata(typed); ok {
+				_ = s.tokenSecrets.Update(secret)
+			}
+		case *corev1.Pod:
+			pod, _ := stripPod(typed)
+			_ = s.pods.Update(pod)
+		}
+	}
+}
+
+func (s *MemoryRBACSource) referenceNamespace(namespace string) {
+	if _, ok := s.namespaces[namespace]; !ok {
+		s.namespaces[namespace] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	}
+}
+
+func (s *MemoryRBACSource) ListNamespaces() ([]*corev1.Namespace, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	namespaces := make([]*corev1.Namespace, 0, len(s.namespaces))
+	for _, namespace := range s.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces, nil
+}
+
+func (s *MemoryRBACSource) ListRoleBindings(namespace string) ([]*rbacv1.RoleBinding, error) {
+	objects, err := s.roleBindings.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+	roleBindings := make([]*rbacv1.RoleBinding, 0, len(objects))
+	for _, object := range objects {
+		roleBindings = append(roleBindings, object.(*rbacv1.RoleBinding))
+	}
+	sort.Slice(roleBindings, func(i, j int) bool { return roleBindings[i].Name < roleBindings[j].Name })
+	return roleBindings, nil
+}
+
+func (s *MemoryRBACSource) ListClusterRoleBindings() ([]*rbacv1.ClusterRoleBinding, error) {
+	objects := s.clusterRoleBindings.List()
+	clusterRoleBindings := make([]*rbacv1.ClusterRoleBinding, 0, len(objects))
+	for _, object := range objects {
+		clusterRoleBindings = append(clusterRoleBindings, object.(*rbacv1.ClusterRoleBinding))
+	}
+	sort.Slice(clusterRoleBindings, func(i, j int) bool { return clusterRoleBindings[i].Name < clusterRoleBindings[j].Name })
+	return clusterRoleBindings, nil
+}
+
+func (s *MemoryRBACSource) RoleBindingsForSubject(subject user.Info) ([]*rbacv1.RoleBinding, error) {
+	return indexedRoleBindings(s.roleBindings, subject)
+}
+
+func (s *MemoryRBACSource) ClusterRoleBindingsForSubject(subject user.Info) ([]*rbacv1.ClusterRoleBinding, error) {
+	return indexedClusterRoleBindings(s.clusterRoleBindings, subject)
+}
+
+func (s *MemoryRBACSource) BoundServiceAccounts(namespace string) ([]string, error) {
+	return boundServiceAccounts(namespace, s.roleBindings, s.clusterRoleBindings)
+}
+
+func (s *MemoryRBACSource) ServiceAccountTokenSecrets(namespace string) (map[string]string, error) {
+	return tokenSecretServiceAccounts(s.tokenSecrets, namespace)
+}
+
+func (s *MemoryRBACSource) ServiceAccountPods(namespace string, serviceAccount string) ([]string, error) {
+	return indexedPodNames(s.pods, namespace, serviceAccount)
+}
+
+func (s *MemoryRBACSource) GetPodServiceAccount(namespace string, name string) (string, error) {
+	object, ok, err := s.pods.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", apierrors.NewNotFound(corev1.Resource("pod"), name)
+	}
+	return podServiceAccount(object.(*corev1.Pod)), nil
+}
+
+func (s *MemoryRBACSource) GetRole(namespace string, name string) (*rbacv1.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	role, ok := s.roles[namespace][name]
+	if !ok {
+		return nil, apierrors.NewNotFound(rbacv1.Resource("role"), name)
+	}
+	return role, nil
+}
+
+func (s *MemoryRBACSource) GetClusterRole(name string) (*rbacv1.ClusterRole, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	clusterRole, ok := s.clusterRoles[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(rbacv1.Resource("clusterrole"), name)
+	}
+	return clusterRole, nil
+}
+
+func (s *MemoryRBACSource) ListClusterRoles() ([]*rbacv1.ClusterRole, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	clusterRoles := make([]*rbacv1.ClusterRole, 0, len(s.clusterRoles))
+	for _, clusterRole := range s.clusterRoles {
+		clusterRoles = append(clusterRoles, clusterRole)
+	}
+	sort.Slice(clusterRoles, func(i, j int) bool { return clusterRoles[i].Name < clusterRoles[j].Name })
+	return clusterRoles, nil
+}
+
+func (s *MemoryRBACSource) GetServiceAccount(name string, namespace string) (user.Info, error) {
+	return util.ServiceAccountUser(name, namespace), nil
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"errors"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	PhaseExtract        = "extract"
+	PhaseIdentity       = "identity"
+	PhaseNamespacedScan = "namespaced_scan"
+	PhaseClusterScan    = "cluster_scan"
+	PhaseTransitive     = "transitive"
+	PhaseBindingScan    = "binding_scan"
+	PhaseRoleUpdateScan = "role_update_scan"
+)
+
+const (
+	ReasonAllowed            = "allowed"
+	ReasonEscalation         = "escalation"
+	ReasonCriticalPermission = "critical_permission"
+	ReasonSaNotFound         = "sa_not_found"
+	ReasonIdentityError      = "identity_error"
+	ReasonInformerError      = "informer_error"
+	ReasonRuleRenderingError = "rule_rendering_error"
+	ReasonInvalidBinding     = "invalid_binding"
+	ReasonInvalidRole        = "invalid_role"
+	ReasonPodSpecError       = "pod_spec_error"
+)
+
+var (
+	admissionDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "admission_decisions_total",
+		Help:      "Number of admission decisions by requested kind, namespace, decision and reason.",
+	}, []string{"group", "version", "kind", "namespace", "decision", "reason"})
+
+	validationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "validation_duration_seconds",
+		Help:      "Duration of the complete validation of an admission request.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	validationPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "validation_phase_duration_seconds",
+		Help:      "Duration of the single phases of the validation of an admission request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"phase"})
+
+	apiCallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "api_call_errors_total",
+		Help:      "Number of failed calls to the kubernetes API.",
+	}, []string{"call"})
+
+	unresolvedRoleRefs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "unresolved_role_refs_total",
+		Help:      "Number of bindings skipped while collecting permissions because their role does not exist.",
+	}, []string{"kind"})
+)
+
+func recordApiCallError(err error) {
+	var apiCallError *util.ApiCallError
+	if errors.As(err, &apiCallError) {
+		apiCallErrors.WithLabelValues(apiCallError.Call).Inc()
+	}
+}
+
+// recordUnresolvedRoleRef logs and counts a binding in namespace whose role does not exist, namespace is empty for ClusterRoleBindings
+func recordUnresolvedRoleRef(logger zerolog.Logger, namespace string, binding string, roleRef rbacv1.RoleRef) {
+	unresolvedRoleRefs.WithLabelValues(roleRef.Kind).Inc()
+	logger.Warn().Str("BindingNamespace", namespace).Str("BindingName", binding).Str("RoleKind", roleRef.Kind).Str("RoleName", roleRef.Name).Msg("Skipping binding to missing role")
+}
+
+// RegisterInformerMetrics exposes the number of cached objects of every informer of the source
+func RegisterInformerMetrics(source *InformerRBACSource) {
+	cacheSize := func(resource string, count func() (int, error)) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "sa_rbac_validator",
+			Name:        "informer_cache_objects",
+			Help:        "Number of objects in the informer caches.",
+			ConstLabels: prometheus.Labels{"resource": resource},
+		}, func() float64 {
+			size, err := count()
+			if err != nil {
+				return -1
+			}
+			return float64(size)
+		})
+	}
+	cacheSize("clusterrolebindings", func() (int, error) {
+		objects, err := source.ClusterRoleBindingInformer.Lister().List(labels.Everything())
+		return len(objects), err
+	})
+	cacheSize("rolebindings", func() (int, error) {
+		objects, err := source.RoleBindingInformer.Lister().List(labels.Everything())
+		return len(objects), err
+	})
+	cacheSize("clusterroles", func() (int, error) {
+		objects, err := source.ClusterRoleInformer.Lister().List(labels.Everything())
+		return len(objects), err
+	})
+	cacheSize("roles", func() (int, error) {
+		objects, err := source.RoleInformer.Lister().List(labels.Everything())
+		return len(objects), err
+	})
+	cacheSize("namespaces", func() (int, error) {
+		objects, err := source.NamespaceInformer.Lister().List(labels.Everything())
+		return len(objects), err
+	})
+}
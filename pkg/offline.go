@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// NewStaticRBACSource returns a RBACSource serving the Roles, ClusterRoles, bindings and Namespaces of manifests.
+// Other kinds are ignored and namespaced objects without namespace are placed in defaultNamespace.
+func NewStaticRBACSource(manifests [][]byte, defaultNamespace string, logger zerolog.Logger) *MemoryRBACSource {
+	return NewMemoryRBACSource(DecodeRBACObjects(manifests, defaultNamespace, logger)...)
+}
+
+// DecodeRBACObjects decodes the Roles, ClusterRoles, bindings, Namespaces and ServiceAccount token Secrets of manifests
+// and skips all other kinds. The data of token Secrets is dropped.
+// Namespaced objects without namespace are placed in defaultNamespace.
+func DecodeRBACObjects(manifests [][]byte, defaultNamespace string, logger zerolog.Logger) []runtime.Object {
+	var objects []runtime.Object
+	deserializer := scheme.Codecs.UniversalDeserializer()
+	for _, manifest := range manifests {
+		object, _, err := deserializer.Decode(manifest, nil, nil)
+		if err != nil {
+			logger.Debug().Err(err).Msg("Skipping manifest")
+			continue
+		}
+		switch typed := object.(type) {
+		case *rbacv1.Role:
+			typed.Namespace = namespaceOrDefault(typed.Namespace, defaultNamespace)
+		case *rbacv1.RoleBinding:
+			typed.Namespace = namespaceOrDefault(typed.Namespace, defaultNamespace)
+		case *rbacv1.ClusterRole, *rbacv1.ClusterRoleBinding, *corev1.Namespace:
+		case *corev1.Secret:
+			secret, ok := tokenSecretMetadata(typed)
+			if !ok {
+				continue
+			}
+			secret.Namespace = namespaceOrDefault(secret.Namespace, defaultNamespace)
+			object = secret
+		default:
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return append(objects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: defaultNamespace}})
+}
+
+// SnapshotRBAC lists the Roles, ClusterRoles, bindings and Namespaces of a live cluster
+func SnapshotRBAC(ctx context.Context, client kubernetes.Interface) ([]runtime.Object, error) {
+	var objects []runtime.Object
+	roles, err := client.RbacV1().Roles("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New("Failed to list Roles: " + err.Error())
+	}
+	for i := range roles.Items {
+		objects = append(objects, &roles.Items[i])
+	}
+	roleBindings, err := client.RbacV1().RoleBindings("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New("Failed to list RoleBindings: " + err.Error())
+	}
+	for i := range roleBindings.Items {
+		objects = append(objects, &roleBindings.Items[i])
+	}
+	clusterRoles, err := client.RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New("Failed to list ClusterRoles: " + err.Error())
+	}
+	for i := range clusterRoles.Items {
+		objects = append(objects, &clusterRoles.Items[i])
+	}
+	clusterRoleBindings, err := client.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New("Failed to list ClusterRoleBindings: " + err.Error())
+	}
+	for i := range clusterRoleBindings.Items {
+		objects = append(objects, &clusterRoleBindings.Items[i])
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New("Failed to list Namespaces: " + err.Error())
+	}
+	for i := range namespaces.Items {
+		objects = append(objects, &namespaces.Items[i])
+	}
+	return objects, nil
+}
+
+// NewAdmissionRequest builds the CREATE AdmissionRequest the apiserver would send for the manifest
+func NewAdmissionRequest(manifest []byte, userInfo authenticationv1.UserInfo, defaultNamespace string) (*admissionv1.AdmissionRequest, error) {
+	var object unstructured.Unstructured
+	if err := object.UnmarshalJSON(manifest); err != nil {
+		return nil, err
+	}
+	gvk := object.GroupVersionKind()
+	namespace := namespaceOrDefault(object.GetNamespace(), defaultNamespace)
+	name := object.GetName()
+	return &admissionv1.AdmissionRequest{
+		UID:       types.UID(gvk.Kind + "/" + namespace + "/" + name),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Name:      name,
+		Namespace: namespace,
+		Operation: admissionv1.Create,
+		UserInfo:  userInfo,
+		Object:    runtime.RawExtension{Raw: manifest},
+	}, nil
+}
+
+func namespaceOrDefault(namespace string, defaultNamespace string) string {
+	if namespace == "" {
+		return defaultNamespace
+	}
+	return namespace
+}
@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	permissionCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "permission_cache_requests_total",
+		Help:      "Number of lookups of effective permissions in the cache by result.",
+	}, []string{"result"})
+
+	permissionCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "permission_cache_evictions_total",
+		Help:      "Number of effective permissions evicted from the cache because it was full.",
+	})
+
+	permissionCacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "permission_cache_invalidations_total",
+		Help:      "Number of effective permissions removed from the cache because a Role, ClusterRole or binding changed.",
+	})
+
+	permissionCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sa_rbac_validator",
+		Name:      "permission_cache_entries",
+		Help:      "Number of effective permissions in the cache.",
+	})
+)
+
+// PermissionCache holds the computed effective permissions per scope and subject, evicting the least recently used
+// entries beyond its size. Entries are invalidated when a binding of a matching subject or a referenced Role or ClusterRole changes.
+// Cached permissions are shared and must not be modified.
+type PermissionCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// dependents maps subject and role keys to the keys of the entries computed from them
+	dependents map[string]map[string]bool
+	// generation is increased with every invalidation, so results computed before are not stored
+	generation uint64
+}
+
+type permissionCacheEntry struct {
+	key          string
+	value        interface{}
+	dependencies []string
+}
+
+// NewPermissionCache returns a PermissionCache holding at most size entries
+func NewPermissionCache(size int) *PermissionCache {
+	return &PermissionCache{
+		size:       size,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		dependents: make(map[string]map[string]bool),
+	}
+}
+
+// Watch invalidates the entries affected by changes of the objects of the informers of source
+func (c *PermissionCache) Watch(source *InformerRBACSource) error {
+	handlers := []struct {
+		informer cache.SharedIndexInformer
+		keys     func(obj interface{}) []string
+	}{
+		{source.RoleInformer.Informer(), func(obj interface{}) []string {
+			if role, ok := obj.(*rbacv1.Role); ok {
+				return []string{roleDependency(role.Namespace, role.Name)}
+			}
+			return nil
+		}},
+		{source.ClusterRoleInformer.Informer(), func(obj interface{}) []string {
+			if clusterRole, ok := obj.(*rbacv1.ClusterRole); ok {
+				return []string{clusterRoleDependency(clusterRole.Name)}
+			}
+			return nil
+		}},
+		{source.RoleBindingInformer.Informer(), func(obj interface{}) []string {
+			if roleBinding, ok := obj.(*rbacv1.RoleBinding); ok {
+				return subjectDependencies(subjectKeys(roleBinding.Subjects, roleBinding.Namespace))
+			}
+			return nil
+		}},
+		{source.ClusterRoleBindingInformer.Informer(), func(obj interface{}) []string {
+			if clusterRoleBinding, ok := obj.(*rbacv1.ClusterRoleBinding); ok {
+				return subjectDependencies(subjectKeys(clusterRoleBinding.Subjects, ""))
+			}
+			return nil
+		}},
+	}
+	for _, handler := range handlers {
+		keys := handler.keys
+		_, err := handler.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.invalidate(keys(obj))
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				c.invalidate(append(keys(oldObj), keys(newObj)...))
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				c.invalidate(keys(obj))
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the cached value of scope for subject or stores the result of compute.
+// compute returns the value and the keys of the Roles and ClusterRoles it was computed from.
+func (c *PermissionCache) get(scope string, subject user.Info, compute func() (interface{}, []string, error)) (interface{}, error) {
+	key := scope + "\x00" + subjectCacheKey(subject)
+	c.mutex.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		c.mutex.Unlock()
+		permissionCacheRequests.WithLabelValues("hit").Inc()
+		return element.Value.(*permissionCacheEntry).value, nil
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+	permissionCacheRequests.WithLabelValues("miss").Inc()
+
+	value, roleDependencies, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return value, nil
+	}
+	if _, ok := c.entries[key]; ok {
+		return value, nil
+	}
+	entry := &permissionCacheEntry{
+		key:          key,
+		value:        value,
+		dependencies: append(subjectDependencies(util.UserSubjectKeys(subject)), roleDependencies...),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for _, dependency := range entry.dependencies {
+		if c.dependents[dependency] == nil {
+			c.dependents[dependency] = make(map[string]bool)
+		}
+		c.dependents[dependency][key] = true
+	}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back().Value.(*permissionCacheEntry))
+		permissionCacheEvictions.Inc()
+	}
+	permissionCacheEntries.Set(float64(c.lru.Len()))
+	return value, nil
+}
+
+func (c *PermissionCache) invalidate(dependencies []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	for _, dependency := range dependencies {
+		for key := range c.dependents[dependency] {
+			if element, ok := c.entries[key]; ok {
+				c.remove(element.Value.(*permissionCacheEntry))
+				permissionCacheInvalidations.Inc()
+			}
+		}
+	}
+	permissionCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// remove must be called with the mutex held
+func (c *PermissionCache) remove(entry *permissionCacheEntry) {
+	c.lru.Remove(c.entries[entry.key])
+	delete(c.entries, entry.key)
+	for _, dependency := range entry.dependencies {
+		delete(c.dependents[dependency], entry.key)
+		if len(c.dependents[dependency]) == 0 {
+			delete(c.dependents, dependency)
+		}
+	}
+}
+
+func subjectCacheKey(subject user.Info) string {
+	groups := append([]string(nil), subject.GetGroups()...)
+	sort.Strings(groups)
+	return subject.GetName() + "\x00" + strings.Join(groups, "\x00")
+}
+
+func subjectDependencies(subjectKeys []string) []string {
+	dependencies := make([]string, 0, len(subjectKeys))
+	for _, subjectKey := range subjectKeys {
+		dependencies = append(dependencies, "Subject/"+subjectKey)
+	}
+	return dependencies
+}
+
+func roleDependency(namespace string, name string) string {
+	return "Role/" + namespace + "/" + name
+}
+
+func clusterRoleDependency(name string) string {
+	return "ClusterRole/" + name
+}
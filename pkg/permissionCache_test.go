@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/informers"
+)
+
+func TestPermissionCacheInvalidation(t *testing.T) {
+	client := newTestClient(testRBACObjects()...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	source, err := NewInformerRBACSource(client, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissionCache := NewPermissionCache(10)
+	if err := permissionCache.Watch(source); err != nil {
+		t.Fatal(err)
+	}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	factory.Start(stopper)
+	factory.WaitForCacheSync(stopper)
+	config := SaRbacValidatorConfig{Source: source, PermissionCache: permissionCache}
+	subject := newTestRequest(t, "", "alice").UserInfo
+
+	namespacedRules := func() []rbacv1.PolicyRule {
+		permissions, err := GetNamespacedPermissions(&user.DefaultInfo{Name: subject.Username, Groups: subject.Groups}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return permissions[testNamespace]
+	}
+	if rules := namespacedRules(); len(rules) != 1 || len(rules[0].Verbs) != 3 {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+	if entries := permissionCache.lru.Len(); entries != 1 {
+		t.Fatalf("expected 1 cached entry, got %d", entries)
+	}
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: testNamespace},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+	}
+	if _, err := client.RbacV1().Roles(testNamespace).Update(context.Background(), role, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		rules := namespacedRules()
+		return len(rules) == 1 && len(rules[0].Verbs) == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("cached permissions were not invalidated after the Role was updated: %v", namespacedRules())
+	}
+
+	// Changing a Role the subject is not bound to keeps the cached entry
+	admin := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: testNamespace}}
+	if _, err := client.RbacV1().Roles(testNamespace).Update(context.Background(), admin, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		adminRole, err := source.GetRole(testNamespace, "admin")
+		return err == nil && len(adminRole.Rules) == 0, nil
+	})
+	if err != nil {
+		t.Fatal("informer did not observe the admin Role update")
+	}
+	permissionCache.mutex.Lock()
+	entries := len(permissionCache.entries)
+	permissionCache.mutex.Unlock()
+	if entries != 1 {
+		t.Fatalf("expected the cached entry to survive an unrelated update, got %d entries", entries)
+	}
+}
+
+func TestPermissionCacheSize(t *testing.T) {
+	permissionCache := NewPermissionCache(2)
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := permissionCache.get("cluster", &user.DefaultInfo{Name: name}, func() (interface{}, []string, error) {
+			return []rbacv1.PolicyRule{}, nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(permissionCache.entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(permissionCache.entries))
+	}
+	if _, ok := permissionCache.entries["cluster\x00"+subjectCacheKey(&user.DefaultInfo{Name: "a"})]; ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+}
+
+func TestPermissionCacheMissingRole(t *testing.T) {
+	client := newTestClient(testRBACObjects()...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	source, err := NewInformerRBACSource(client, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissionCache := NewPermissionCache(10)
+	if err := permissionCache.Watch(source); err != nil {
+		t.Fatal(err)
+	}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	factory.Start(stopper)
+	factory.WaitForCacheSync(stopper)
+	config := SaRbacValidatorConfig{Source: source, PermissionCache: permissionCache}
+	subject := &user.DefaultInfo{Name: "system:serviceaccount:" + testNamespace + ":broken"}
+
+	namespacedRules := func() []rbacv1.PolicyRule {
+		permissions, err := GetNamespacedPermissions(subject, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return permissions[testNamespace]
+	}
+	if rules := namespacedRules(); len(rules) != 0 {
+		t.Fatalf("expected the binding to the missing role to grant nothing, got %v", rules)
+	}
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing", Namespace: testNamespace},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+	}
+	if _, err := client.RbacV1().Roles(testNamespace).Create(context.Background(), role, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(namespacedRules()) == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("cached permissions were not invalidated after the missing Role was created: %v", namespacedRules())
+	}
+}
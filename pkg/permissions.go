@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"github.com/rs/zerolog"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// GetNamespacedPermissions returns the extended rules the subject holds through RoleBindings, keyed by namespace.
+// Namespaces without any rules for the subject are omitted. The result is cached if the config has a PermissionCache.
+func GetNamespacedPermissions(subject user.Info, saRbacValidatorConfig SaRbacValidatorConfig) (map[string][]rbacv1.PolicyRule, error) {
+	if saRbacValidatorConfig.PermissionCache == nil {
+		permissions, _, err := computeNamespacedPermissions(subject, saRbacValidatorConfig.Source, saRbacValidatorConfig.Logger)
+		return permissions, err
+	}
+	permissions, err := saRbacValidatorConfig.PermissionCache.get("namespaced", subject, func() (interface{}, []string, error) {
+		return computeNamespacedPermissions(subject, saRbacValidatorConfig.Source, saRbacValidatorConfig.Logger)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return permissions.(map[string][]rbacv1.PolicyRule), nil
+}
+
+// GetClusterPermissions returns the extended rules the subject holds through ClusterRoleBindings.
+// The result is cached if the config has a PermissionCache.
+func GetClusterPermissions(subject user.Info, saRbacValidatorConfig SaRbacValidatorConfig) ([]rbacv1.PolicyRule, error) {
+	if saRbacValidatorConfig.PermissionCache == nil {
+		rules, _, err := computeClusterPermissions(subject, saRbacValidatorConfig.Source, saRbacValidatorConfig.Logger)
+		return rules, err
+	}
+	rules, err := saRbacValidatorConfig.PermissionCache.get("cluster", subject, func() (interface{}, []string, error) {
+		return computeClusterPermissions(subject, saRbacValidatorConfig.Source, saRbacValidatorConfig.Logger)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules.([]rbacv1.PolicyRule), nil
+}
+
+// computeNamespacedPermissions returns the namespaced permissions of the subject and the keys of the referenced roles.
+// Like the RBAC authorizer of the apiserver, bindings to missing roles grant nothing. Their keys are still returned, so
+// cached permissions are invalidated once the role is created.
+func computeNamespacedPermissions(subject user.Info, source RBACSource, logger zerolog.Logger) (map[string][]rbacv1.PolicyRule, []string, error) {
+	roleBindings, err := source.RoleBindingsForSubject(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	ruleSets := make(map[string]*util.RuleSet)
+	var dependencies []string
+	for _, roleBinding := range roleBindings {
+		if roleBinding.RoleRef.Kind == "Role" {
+			dependencies = append(dependencies, roleDependency(roleBinding.Namespace, roleBinding.RoleRef.Name))
+		} else {
+			dependencies = append(dependencies, clusterRoleDependency(roleBinding.RoleRef.Name))
+		}
+		rules, err := getRulesForRoleBinding(roleBinding, source)
+		if apierrors.IsNotFound(err) {
+			recordUnresolvedRoleRef(logger, roleBinding.Namespace, roleBinding.Name, roleBinding.RoleRef)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if ruleSets[roleBinding.Namespace] == nil {
+			ruleSets[roleBinding.Namespace] = util.NewRuleSet()
+		}
+		ruleSets[roleBinding.Namespace].Add(rules...)
+	}
+	permissions := make(map[string][]rbacv1.PolicyRule)
+	for namespace, ruleSet := range ruleSets {
+		if !ruleSet.IsEmpty() {
+			permissions[namespace] = ruleSet.Rules()
+		}
+	}
+	return permissions, dependencies, nil
+}
+
+// computeClusterPermissions returns the cluster permissions of the subject and the keys of the referenced roles.
+// Bindings to missing ClusterRoles grant nothing.
+func computeClusterPermissions(subject user.Info, source RBACSource, logger zerolog.Logger) ([]rbacv1.PolicyRule, []string, error) {
+	clusterRoleBindings, err := source.ClusterRoleBindingsForSubject(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	clusterRuleSet := util.NewRuleSet()
+	var dependencies []string
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		dependencies = append(dependencies, clusterRoleDependency(clusterRoleBinding.RoleRef.Name))
+		rules, err := getRulesForClusterRoleBinding(clusterRoleBinding, source)
+		if apierrors.IsNotFound(err) {
+			recordUnresolvedRoleRef(logger, "", clusterRoleBinding.Name, clusterRoleBinding.RoleRef)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		clusterRuleSet.Add(rules...)
+	}
+	return clusterRuleSet.Rules(), dependencies, nil
+}
+
+func getRulesForRoleBinding(roleBinding *rbacv1.RoleBinding, source RBACSource) ([]rbacv1.PolicyRule, error) {
+	if roleBinding.RoleRef.Kind == "Role" {
+		role, err := source.GetRole(roleBinding.Namespace, roleBinding.RoleRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		return role.Rules, nil
+	}
+	clusterRole, err := source.GetClusterRole(roleBinding.RoleRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	return clusterRole.Rules, nil
+}
+
+func getRulesForClusterRoleBinding(clusterRoleBinding *rbacv1.ClusterRoleBinding, source RBACSource) ([]rbacv1.PolicyRule, error) {
+	clusterRole, err := source.GetClusterRole(clusterRoleBinding.RoleRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	return clusterRole.Rules, nil
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// podServiceAccountJsonPointer points to the ServiceAccount in the pods of ephemeralcontainers updates
+const podServiceAccountJsonPointer = "/spec/serviceAccountName"
+
+// ValidatePodAccess validates access to running pods and records the metrics of the decision
+func ValidatePodAccess(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	report := EvaluatePodAccess(ctx, request, saRbacValidatorConfig)
+	return recordDecision(request, report, start)
+}
+
+// EvaluatePodAccess compares the permissions of the ServiceAccount of a running pod with the permissions of the requester,
+// if the request adds ephemeral containers to the pod or executes in or attaches to its containers. Both allow to act as the
+// ServiceAccount of the pod without creating a workload.
+func EvaluatePodAccess(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *Report {
+	switch request.SubResource {
+	case "ephemeralcontainers":
+		// The object is the pod with the added containers, so its tokens are inspected like on creation
+		saRbacValidatorConfig.ServiceAccountJsonPointer = podServiceAccountJsonPointer
+		return Evaluate(ctx, request, saRbacValidatorConfig)
+	case "exec", "attach":
+		// The object are the PodExecOptions or PodAttachOptions, the pod is looked up by the name of the request
+		lookup := func(request *admissionv1.AdmissionRequest) (string, error) {
+			return saRbacValidatorConfig.Source.GetPodServiceAccount(request.Namespace, request.Name)
+		}
+		return evaluate(ctx, request, saRbacValidatorConfig, lookup, false)
+	}
+	return newReport(request).allow(ReasonAllowed, "Subresource "+request.SubResource+" grants no access to the ServiceAccount of the pod")
+}
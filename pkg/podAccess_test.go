@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEvaluatePodAccess(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "admin-pod", Namespace: testNamespace}, Spec: corev1.PodSpec{ServiceAccountName: "admin"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build-1", Namespace: testNamespace}, Spec: corev1.PodSpec{ServiceAccountName: "builder"}},
+	)
+	tests := []struct {
+		name           string
+		operation      admissionv1.Operation
+		subResource    string
+		pod            string
+		serviceAccount string
+		allowed        bool
+		reason         string
+	}{
+		{name: "exec into a pod with a service account not held by the requester is denied", operation: admissionv1.Connect, subResource: "exec", pod: "admin-pod", reason: ReasonEscalation},
+		{name: "attach to a pod with a service account held by the requester is allowed", operation: admissionv1.Connect, subResource: "attach", pod: "build-1", allowed: true, reason: ReasonAllowed},
+		{name: "exec into a missing pod is denied", operation: admissionv1.Connect, subResource: "exec", pod: "missing", reason: ReasonSaNotFound},
+		{name: "ephemeral containers in a pod with a service account not held by the requester are denied", operation: admissionv1.Update, subResource: "ephemeralcontainers", pod: "admin-pod", serviceAccount: "admin", reason: ReasonEscalation},
+		{name: "other subresources are allowed", operation: admissionv1.Update, subResource: "status", pod: "admin-pod", serviceAccount: "admin", allowed: true, reason: ReasonAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SaRbacValidatorConfig{
+				Logger:                    zerolog.Nop(),
+				Source:                    NewMemoryRBACSource(objects...),
+				ServiceAccountJsonPointer: "/spec/template/spec/serviceAccountName",
+				SaNotFoundBehavior:        Deny,
+			}
+			request := newTestRequest(t, test.serviceAccount, "alice")
+			request.Name = test.pod
+			request.Operation = test.operation
+			request.SubResource = test.subResource
+			if test.operation == admissionv1.Connect {
+				request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "PodExecOptions"}
+				request.Object.Raw = []byte(`{"kind":"PodExecOptions","apiVersion":"v1","command":["sh"]}`)
+			}
+
+			report := EvaluatePodAccess(context.Background(), request, config)
+			if report.Allowed != test.allowed || report.Reason != test.reason {
+				t.Errorf("expected allowed %t with reason %q, got %t with %q: %s", test.allowed, test.reason, report.Allowed, report.Reason, report.Message)
+			}
+		})
+	}
+}
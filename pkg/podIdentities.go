@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"strings"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// serviceAccountNameField is the last token of JSON pointers to the ServiceAccount of a PodSpec
+const serviceAccountNameField = "/serviceAccountName"
+
+// podTokens are the ServiceAccount tokens a pod can obtain
+type podTokens struct {
+	// ownToken is false if the pod disables the automount of its ServiceAccount token and projects no token
+	ownToken bool
+	// tokenSecretServiceAccounts are the ServiceAccounts of the legacy token Secrets the pod mounts or references
+	tokenSecretServiceAccounts []string
+}
+
+// identities returns the identities the pod can act as and the names of the ServiceAccounts of its token Secrets as namespace/name
+func (t *podTokens) identities(serviceAccountUser user.Info, serviceAccount string, namespace string) ([]user.Info, []string) {
+	var identities []user.Info
+	var tokenServiceAccounts []string
+	if t.ownToken {
+		identities = append(identities, serviceAccountUser)
+	}
+	for _, name := range t.tokenSecretServiceAccounts {
+		if t.ownToken && name == serviceAccount {
+			continue
+		}
+		identities = append(identities, util.ServiceAccountUser(name, namespace))
+		tokenServiceAccounts = append(tokenServiceAccounts, namespace+"/"+name)
+	}
+	return identities, tokenServiceAccounts
+}
+
+// podSpecKinds are the kinds of the built-in resources containing a PodSpec
+var podSpecKinds = map[schema.GroupKind]bool{
+	{Group: "", Kind: "Pod"}:                   true,
+	{Group: "", Kind: "PodTemplate"}:           true,
+	{Group: "", Kind: "ReplicationController"}: true,
+	{Group: "apps", Kind: "Deployment"}:        true,
+	{Group: "apps", Kind: "ReplicaSet"}:        true,
+	{Group: "apps", Kind: "StatefulSet"}:       true,
+	{Group: "apps", Kind: "DaemonSet"}:         true,
+	{Group: "batch", Kind: "Job"}:              true,
+	{Group: "batch", Kind: "CronJob"}:          true,
+}
+
+// extractPodTokens inspects the PodSpec containing the ServiceAccount JSON pointer for the tokens the pod can obtain.
+// It returns false for kinds without a PodSpec, e.g. custom resources, and if the pointer does not end in the
+// serviceAccountName of a PodSpec. Secrets are only inspected with LegacyTokenAnalysis as the Source serves no token
+// Secrets otherwise.
+func extractPodTokens(request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) (*podTokens, bool, error) {
+	if !podSpecKinds[schema.GroupKind{Group: request.Kind.Group, Kind: request.Kind.Kind}] || !strings.HasSuffix(saRbacValidatorConfig.ServiceAccountJsonPointer, serviceAccountNameField) {
+		return nil, false, nil
+	}
+	podSpec, err := util.ExtractPodSpec(request, strings.TrimSuffix(saRbacValidatorConfig.ServiceAccountJsonPointer, serviceAccountNameField))
+	if err != nil {
+		return nil, false, err
+	}
+	tokens := &podTokens{ownToken: podSpec.AutomountServiceAccountToken == nil || *podSpec.AutomountServiceAccountToken}
+	for _, volume := range podSpec.Volumes {
+		if volume.Projected == nil {
+			continue
+		}
+		for _, source := range volume.Projected.Sources {
+			if source.ServiceAccountToken != nil {
+				tokens.ownToken = true
+			}
+		}
+	}
+	if !saRbacValidatorConfig.LegacyTokenAnalysis {
+		return tokens, true, nil
+	}
+	secrets := podSecrets(podSpec)
+	if len(secrets) == 0 {
+		return tokens, true, nil
+	}
+	tokenSecrets, err := saRbacValidatorConfig.Source.ServiceAccountTokenSecrets(request.Namespace)
+	if err != nil {
+		return nil, false, err
+	}
+	tokens.tokenSecretServiceAccounts = tokenSecretServiceAccountNames(tokenSecrets, secrets)
+	return tokens, true, nil
+}
+
+// podSecrets returns the names of the Secrets the pod mounts or references in the environment of its containers
+func podSecrets(podSpec *corev1.PodSpec) []string {
+	names := make(map[string]bool)
+	for _, volume := range podSpec.Volumes {
+		if volume.Secret != nil {
+			names[volume.Secret.SecretName] = true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					names[source.Secret.Name] = true
+				}
+			}
+		}
+	}
+	addEnvSecrets := func(env []corev1.EnvVar, envFrom []corev1.EnvFromSource) {
+		for _, variable := range env {
+			if variable.ValueFrom != nil && variable.ValueFrom.SecretKeyRef != nil {
+				names[variable.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+		for _, source := range envFrom {
+			if source.SecretRef != nil {
+				names[source.SecretRef.Name] = true
+			}
+		}
+	}
+	for _, container := range podSpec.InitContainers {
+		addEnvSecrets(container.Env, container.EnvFrom)
+	}
+	for _, container := range podSpec.Containers {
+		addEnvSecrets(container.Env, container.EnvFrom)
+	}
+	for _, container := range podSpec.EphemeralContainers {
+		addEnvSecrets(container.Env, container.EnvFrom)
+	}
+	return sortedNames(names)
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podServiceAccountIndex is the name of the index of pods by namespace/name of their ServiceAccount
+const podServiceAccountIndex = "serviceAccount"
+
+var podIndexers = cache.Indexers{
+	podServiceAccountIndex: func(obj interface{}) ([]string, error) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return nil, nil
+		}
+		return []string{pod.Namespace + "/" + podServiceAccount(pod)}, nil
+	},
+}
+
+// podServiceAccount returns the ServiceAccount the pod runs as, the admission of the apiserver sets default if none is given
+func podServiceAccount(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// stripPod reduces pods to the fields the validator reads to keep the informer cache small
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			OwnerReferences: pod.OwnerReferences,
+		},
+		Spec: corev1.PodSpec{ServiceAccountName: podServiceAccount(pod)},
+	}, nil
+}
+
+// WatchPods creates the pod informer in factory which lists the pods affected by permission changes of their ServiceAccount
+// and resolves the ServiceAccounts of exec and attach targets without API calls. The factory has to be started afterwards.
+func (s *InformerRBACSource) WatchPods(factory informers.SharedInformerFactory) error {
+	s.PodInformer = factory.Core().V1().Pods()
+	if err := s.PodInformer.Informer().SetTransform(stripPod); err != nil {
+		return err
+	}
+	return s.PodInformer.Informer().AddIndexers(podIndexers)
+}
+
+func (s *InformerRBACSource) ServiceAccountPods(namespace string, serviceAccount string) ([]string, error) {
+	if s.PodInformer == nil {
+		return nil, nil
+	}
+	return indexedPodNames(s.PodInformer.Informer().GetIndexer(), namespace, serviceAccount)
+}
+
+func (s *InformerRBACSource) GetPodServiceAccount(namespace string, name string) (string, error) {
+	if s.PodInformer != nil {
+		pod, err := s.PodInformer.Lister().Pods(namespace).Get(name)
+		if err != nil {
+			return "", err
+		}
+		return podServiceAccount(pod), nil
+	}
+	pod, err := s.Client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return podServiceAccount(pod), nil
+}
+
+// indexedPodNames returns the sorted names of the pods of namespace running as serviceAccount
+func indexedPodNames(indexer cache.Indexer, namespace string, serviceAccount string) ([]string, error) {
+	objects, err := indexer.ByIndex(podServiceAccountIndex, namespace+"/"+serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.(*corev1.Pod).Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
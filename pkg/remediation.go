@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"regexp"
+	"strings"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"sigs.k8s.io/yaml"
+)
+
+// Remediation holds the two ways to resolve an escalation as manifests
+type Remediation struct {
+	// RequesterGrant are the Roles and bindings a platform admin can apply to grant the requester the missing permissions
+	RequesterGrant string `json:"requesterGrant"`
+	// ServiceAccountReduction are the Roles and bindings for the ServiceAccount that stay within the permissions of the requester.
+	// They replace the current bindings of the ServiceAccount in the escalated scopes.
+	ServiceAccountReduction string `json:"serviceAccountReduction"`
+}
+
+// subjectPermissions are the namespaced and cluster permissions of a subject
+type subjectPermissions struct {
+	namespaced map[string][]rbacv1.PolicyRule
+	cluster    []rbacv1.PolicyRule
+}
+
+var invalidNameCharacters = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// remediationName returns a valid object name derived from parts
+func remediationName(parts ...string) string {
+	name := invalidNameCharacters.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-")
+	name = strings.Trim(name, "-.")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return name
+}
+
+// requesterSubject returns the binding subject of the requester
+func requesterSubject(username string) rbacv1.Subject {
+	if namespace, name, err := serviceaccount.SplitUsername(username); err == nil {
+		return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: namespace}
+	}
+	return rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: username}
+}
+
+// newRemediation builds the remediation of the escalations of report
+func newRemediation(report *Report, serviceAccountNamespace string, serviceAccountPermissions subjectPermissions, requesterPermissions subjectPermissions) (*Remediation, error) {
+	requester := requesterSubject(report.User)
+	serviceAccount := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: report.ServiceAccount, Namespace: serviceAccountNamespace}
+	grantName := remediationName("sa-rbac-validator", report.User)
+	reductionName := remediationName(report.ServiceAccount, "reduced")
+
+	var grant []interface{}
+	var reduction []interface{}
+	if len(report.ClusterEscalations) > 0 {
+		grant = append(grant, clusterRoleAndBinding(grantName, util.CompactRules(report.ClusterEscalations), requester)...)
+		reduced := util.NewRuleSet(serviceAccountPermissions.cluster...).Intersection(util.NewRuleSet(requesterPermissions.cluster...))
+		reduction = append(reduction, clusterRoleAndBinding(remediationName(serviceAccountNamespace, reductionName), reduced.CompactRules(), serviceAccount)...)
+	}
+	for _, namespace := range report.EscalatedNamespaces() {
+		grant = append(grant, roleAndBinding(grantName, namespace, util.CompactRules(report.NamespacedEscalations[namespace]), requester)...)
+		heldRules := util.NewRuleSet(requesterPermissions.namespaced[namespace]...).Union(util.NewRuleSet(requesterPermissions.cluster...))
+		reduced := util.NewRuleSet(serviceAccountPermissions.namespaced[namespace]...).Intersection(heldRules)
+		reduction = append(reduction, roleAndBinding(reductionName, namespace, reduced.CompactRules(), serviceAccount)...)
+	}
+
+	requesterGrant, err := manifestsToYAML(grant)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccountReduction, err := manifestsToYAML(reduction)
+	if err != nil {
+		return nil, err
+	}
+	return &Remediation{RequesterGrant: requesterGrant, ServiceAccountReduction: serviceAccountReduction}, nil
+}
+
+func roleAndBinding(name string, namespace string, rules []rbacv1.PolicyRule, subject rbacv1.Subject) []interface{} {
+	if len(rules) == 0 {
+		return nil
+	}
+	return []interface{}{
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Rules:      rules,
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+			Subjects:   []rbacv1.Subject{subject},
+		},
+	}
+}
+
+func clusterRoleAndBinding(name string, rules []rbacv1.PolicyRule, subject rbacv1.Subject) []interface{} {
+	if len(rules) == 0 {
+		return nil
+	}
+	return []interface{}{
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Rules:      rules,
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+			Subjects:   []rbacv1.Subject{subject},
+		},
+	}
+}
+
+// manifestsToYAML renders objects as a multi document YAML without the empty status and creationTimestamp fields
+func manifestsToYAML(objects []interface{}) (string, error) {
+	var documents []string
+	for _, object := range objects {
+		document, err := yaml.Marshal(object)
+		if err != nil {
+			return "", err
+		}
+		documents = append(documents, strings.Replace(string(document), "  creationTimestamp: null\n", "", 1))
+	}
+	return strings.Join(documents, "---\n"), nil
+}
+
+// message returns the remediation as part of a denial message
+func (r *Remediation) message() string {
+	message := "To allow the request either grant the requester the missing permissions:\n" + r.RequesterGrant
+	if r.ServiceAccountReduction == "" {
+		return message + "or remove the escalated permissions from the ServiceAccount."
+	}
+	return message + "or reduce the permissions of the ServiceAccount to:\n" + r.ServiceAccountReduction
+}
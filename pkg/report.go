@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Report is the structured result of the validation of a request
+type Report struct {
+	Kind           string   `json:"kind"`
+	Namespace      string   `json:"namespace,omitempty"`
+	Name           string   `json:"name,omitempty"`
+	User           string   `json:"user,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	ServiceAccount string   `json:"serviceAccount,omitempty"`
+	// BoundServiceAccounts are the ServiceAccounts a validated binding or role grants permissions to, namespace/* stands for all of a namespace
+	BoundServiceAccounts []string `json:"boundServiceAccounts,omitempty"`
+	// AffectedPods are the pods running as the BoundServiceAccounts of a validated role as namespace/name
+	AffectedPods []string `json:"affectedPods,omitempty"`
+	Allowed      bool     `json:"allowed"`
+	Reason       string   `json:"reason"`
+	Message      string   `json:"message"`
+	// ClusterEscalations are the rules the ServiceAccount holds at cluster scope but the requester does not
+	ClusterEscalations []rbacv1.PolicyRule `json:"clusterEscalations,omitempty"`
+	// NamespacedEscalations are the rules the ServiceAccount holds per namespace but the requester does not
+	NamespacedEscalations map[string][]rbacv1.PolicyRule `json:"namespacedEscalations,omitempty"`
+	// ClusterCriticalRules are the escalate, bind and impersonate permissions the ServiceAccount holds at cluster scope
+	ClusterCriticalRules []rbacv1.PolicyRule `json:"clusterCriticalRules,omitempty"`
+	// NamespacedCriticalRules are the escalate, bind and impersonate permissions the ServiceAccount holds per namespace
+	NamespacedCriticalRules map[string][]rbacv1.PolicyRule `json:"namespacedCriticalRules,omitempty"`
+	// TokenServiceAccounts are the ServiceAccounts whose legacy token Secrets the pod mounts or references as namespace/name
+	TokenServiceAccounts []string `json:"tokenServiceAccounts,omitempty"`
+	// ReachableServiceAccounts are the ServiceAccounts whose permissions were added by the transitive analysis, namespace/* stands for all of a namespace
+	ReachableServiceAccounts []string `json:"reachableServiceAccounts,omitempty"`
+	// Warnings are returned to the requester regardless of the decision
+	Warnings []string `json:"warnings,omitempty"`
+	// Remediation offers manifests that resolve the escalations
+	Remediation *Remediation `json:"remediation,omitempty"`
+}
+
+func newReport(request *admissionv1.AdmissionRequest) *Report {
+	return &Report{
+		Kind:      request.Kind.Kind,
+		Namespace: request.Namespace,
+		Name:      request.Name,
+		User:      request.UserInfo.Username,
+		Groups:    request.UserInfo.Groups,
+	}
+}
+
+func (r *Report) allow(reason string, message string) *Report {
+	r.Allowed = true
+	r.Reason = reason
+	r.Message = message
+	return r
+}
+
+func (r *Report) deny(reason string, message string) *Report {
+	r.Allowed = false
+	r.Reason = reason
+	r.Message = message
+	return r
+}
+
+// IsEscalation reports if the ServiceAccount holds any permission the requester does not hold
+func (r *Report) IsEscalation() bool {
+	return len(r.ClusterEscalations) > 0 || len(r.NamespacedEscalations) > 0
+}
+
+// HasCriticalRules reports if the ServiceAccount holds escalate, bind or impersonate permissions
+func (r *Report) HasCriticalRules() bool {
+	return len(r.ClusterCriticalRules) > 0 || len(r.NamespacedCriticalRules) > 0
+}
+
+// EscalatedNamespaces returns the namespaces with escalations in a stable order
+func (r *Report) EscalatedNamespaces() []string {
+	namespaces := make([]string, 0, len(r.NamespacedEscalations))
+	for namespace := range r.NamespacedEscalations {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func (r *Report) escalationMessage() (string, error) {
+	var message string
+	if len(r.ClusterEscalations) > 0 {
+		rulesString, err := util.RulesToString(util.CompactRules(r.ClusterEscalations))
+		if err != nil {
+			return "", err
+		}
+		message = "Request try to grant permissions at Cluster-Scope that are currently not held by user: " + rulesString + "."
+	}
+	for _, namespace := range r.EscalatedNamespaces() {
+		rulesString, err := util.RulesToString(util.CompactRules(r.NamespacedEscalations[namespace]))
+		if err != nil {
+			return "", err
+		}
+		message = message + "Request try to grant permissions in Namespace: " + namespace + " that are currently not held by user: " + rulesString + "."
+	}
+	return message, nil
+}
+
+func (r *Report) criticalRulesMessage() (string, error) {
+	var scopes []string
+	if len(r.ClusterCriticalRules) > 0 {
+		rulesString, err := util.RulesToString(r.ClusterCriticalRules)
+		if err != nil {
+			return "", err
+		}
+		scopes = append(scopes, "at Cluster-Scope: "+rulesString)
+	}
+	namespaces := make([]string, 0, len(r.NamespacedCriticalRules))
+	for namespace := range r.NamespacedCriticalRules {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		rulesString, err := util.RulesToString(r.NamespacedCriticalRules[namespace])
+		if err != nil {
+			return "", err
+		}
+		scopes = append(scopes, "in Namespace: "+namespace+": "+rulesString)
+	}
+	return "ServiceAccount holds critical permissions which allow to gain any permission " + strings.Join(scopes, ", ") + ".", nil
+}
+
+// Response converts the report to the AdmissionResponse for request
+func (r *Report) Response(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	code := int32(http.StatusForbidden)
+	if r.Allowed {
+		code = http.StatusOK
+	}
+	return &admissionv1.AdmissionResponse{
+		UID:      request.UID,
+		Allowed:  r.Allowed,
+		Warnings: r.Warnings,
+		Result: &metav1.Status{
+			Message: r.Message,
+			Code:    code,
+		},
+	}
+}
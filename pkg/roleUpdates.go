@@ -0,0 +1,397 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+)
+
+// maxListedPods bounds the number of affected pods named in messages
+const maxListedPods = 20
+
+// ValidateRoleUpdate validates the change of a Role or ClusterRole and records the metrics of the decision
+func ValidateRoleUpdate(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	report := EvaluateRoleUpdate(ctx, request, saRbacValidatorConfig)
+	return recordDecision(request, report, start)
+}
+
+// EvaluateRoleUpdate compares the rules a Role or ClusterRole gains with the permissions of the requester, if existing bindings
+// grant the role to ServiceAccounts. ClusterRoles also widen the aggregated ClusterRoles selecting them, whose bindings are
+// followed as well. Gained rules held by the requester are allowed with a warning listing the affected ServiceAccounts and
+// pods, all others are denied.
+func EvaluateRoleUpdate(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *Report {
+	logger := saRbacValidatorConfig.Logger.With().Str("Request UID", string(request.UID)).Logger()
+	logger.Info().Msg("Start Validating Role Update")
+	report := newReport(request)
+	user := util.ExtractUser(request)
+
+	change, err := decodeRoleChange(request)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to decode role")
+		return report.deny(ReasonInvalidRole, err.Error())
+	}
+
+	phaseStart := time.Now()
+	_, span := tracer.Start(ctx, "RoleUpdateScan", trace.WithAttributes(RequestUIDAttribute(string(request.UID))))
+	widened, err := change.widenedRoles(saRbacValidatorConfig.Source)
+	if err != nil {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to list aggregated ClusterRoles")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	if len(widened) == 0 {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		span.End()
+		return report.allow(ReasonAllowed, "Role gains no permissions")
+	}
+	serviceAccounts := make(map[string]bool)
+	grants := make([]*roleGrants, 0, len(widened))
+	for _, role := range widened {
+		roleGrants, err := role.affectedServiceAccounts(saRbacValidatorConfig.Source)
+		if err != nil {
+			observePhase(PhaseRoleUpdateScan, phaseStart)
+			endSpan(span, err)
+			logger.Error().Err(err).Msg("Failed to find bindings of role")
+			return report.deny(ReasonInformerError, err.Error())
+		}
+		for serviceAccount := range roleGrants.serviceAccounts {
+			serviceAccounts[serviceAccount] = true
+		}
+		grants = append(grants, roleGrants)
+	}
+	span.SetAttributes(attribute.Int("roles.widened", len(widened)), attribute.Int("serviceaccounts.affected", len(serviceAccounts)))
+	if len(serviceAccounts) == 0 {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		span.End()
+		logger.Info().Msg("Request allowed")
+		return report.allow(ReasonAllowed, "Role is bound to no ServiceAccount")
+	}
+	report.BoundServiceAccounts = sortedNames(serviceAccounts)
+	report.AffectedPods, err = affectedPods(serviceAccounts, saRbacValidatorConfig.Source)
+	if err != nil {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to list pods of affected ServiceAccounts")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+
+	userNamespacedRules, err := GetNamespacedPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get namespaced permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	userClusterRules, err := GetClusterPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		observePhase(PhaseRoleUpdateScan, phaseStart)
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get cluster permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	clusterEscalations := util.NewRuleSet()
+	namespacedEscalations := make(map[string]*util.RuleSet)
+	for i, role := range widened {
+		added := role.added.Rules()
+		if grants[i].clusterScope {
+			clusterEscalations.Add(util.IsRuleEscalation(userClusterRules, added)...)
+		}
+		for namespace := range grants[i].namespaces {
+			heldRules := append(append([]rbacv1.PolicyRule{}, userNamespacedRules[namespace]...), userClusterRules...)
+			if escalationRules := util.IsRuleEscalation(heldRules, added); len(escalationRules) > 0 {
+				if namespacedEscalations[namespace] == nil {
+					namespacedEscalations[namespace] = util.NewRuleSet()
+				}
+				namespacedEscalations[namespace].Add(escalationRules...)
+			}
+		}
+	}
+	if !clusterEscalations.IsEmpty() {
+		report.ClusterEscalations = clusterEscalations.Rules()
+	}
+	for namespace, escalationRules := range namespacedEscalations {
+		if report.NamespacedEscalations == nil {
+			report.NamespacedEscalations = make(map[string][]rbacv1.PolicyRule)
+		}
+		report.NamespacedEscalations[namespace] = escalationRules.Rules()
+	}
+	observePhase(PhaseRoleUpdateScan, phaseStart)
+	span.End()
+
+	affectedMessage := report.affectedMessage()
+	if aggregating := aggregatingRoleNames(widened); len(aggregating) > 0 {
+		affectedMessage = affectedMessage + " The rules are aggregated into the ClusterRoles " + strings.Join(aggregating, ", ") + "."
+	}
+	if report.IsEscalation() {
+		message, err := report.escalationMessage()
+		if err != nil {
+			return report.deny(ReasonRuleRenderingError, err.Error())
+		}
+		logger.Info().Msg("Request denied")
+		return report.deny(ReasonEscalation, message+" "+affectedMessage)
+	}
+	logger.Warn().Strs("ServiceAccounts", report.BoundServiceAccounts).Msg("Role update widens the permissions of ServiceAccounts")
+	report.Warnings = append(report.Warnings, affectedMessage)
+	logger.Info().Msg("Request allowed")
+	return report.allow(ReasonAllowed, "Request allowed")
+}
+
+// affectedMessage names the ServiceAccounts and pods which gain the permissions
+func (r *Report) affectedMessage() string {
+	message := "The permissions are granted to the ServiceAccounts " + strings.Join(r.BoundServiceAccounts, ", ")
+	if len(r.AffectedPods) > 0 {
+		pods := r.AffectedPods
+		if len(pods) > maxListedPods {
+			pods = append(pods[:maxListedPods:maxListedPods], "and "+strconv.Itoa(len(r.AffectedPods)-maxListedPods)+" more")
+		}
+		message = message + " used by the pods " + strings.Join(pods, ", ")
+	}
+	return message + "."
+}
+
+// roleChange are the rules of a Role or ClusterRole before and after the request. namespace is empty for ClusterRoles.
+type roleChange struct {
+	namespace string
+	name      string
+	labels    map[string]string
+	rules     []rbacv1.PolicyRule
+	oldRules  []rbacv1.PolicyRule
+	// aggregationRule is set for aggregated ClusterRoles, whose rules are managed by the aggregation controller
+	aggregationRule *rbacv1.AggregationRule
+}
+
+func decodeRoleChange(request *admissionv1.AdmissionRequest) (*roleChange, error) {
+	change := &roleChange{name: request.Name}
+	switch request.Kind.Kind {
+	case "Role":
+		var role, oldRole rbacv1.Role
+		if err := decodeRoles(request, &role, &oldRole); err != nil {
+			return nil, err
+		}
+		change.namespace = request.Namespace
+		change.labels = role.Labels
+		change.rules, change.oldRules = role.Rules, oldRole.Rules
+	case "ClusterRole":
+		var clusterRole, oldClusterRole rbacv1.ClusterRole
+		if err := decodeRoles(request, &clusterRole, &oldClusterRole); err != nil {
+			return nil, err
+		}
+		change.labels = clusterRole.Labels
+		change.rules, change.oldRules = clusterRole.Rules, oldClusterRole.Rules
+		change.aggregationRule = clusterRole.AggregationRule
+	default:
+		return nil, errors.New("Kind " + request.Kind.Kind + " is no Role or ClusterRole")
+	}
+	return change, nil
+}
+
+// decodeRoles decodes the object and, on updates, the old object of request
+func decodeRoles(request *admissionv1.AdmissionRequest, role interface{}, oldRole interface{}) error {
+	if err := json.Unmarshal(request.Object.Raw, role); err != nil {
+		return errors.New("Failed to decode " + request.Kind.Kind + ": " + err.Error())
+	}
+	if len(request.OldObject.Raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(request.OldObject.Raw, oldRole); err != nil {
+		return errors.New("Failed to decode old " + request.Kind.Kind + ": " + err.Error())
+	}
+	return nil
+}
+
+// widenedRole is a role gaining rules through a request, namespace is empty for ClusterRoles
+type widenedRole struct {
+	namespace string
+	name      string
+	added     *util.RuleSet
+	// aggregated is set for ClusterRoles gaining the rules through their aggregationRule
+	aggregated bool
+}
+
+// widenedRoles returns the changed role if it gains rules and, for ClusterRoles, the aggregated ClusterRoles which select it
+// directly or through other aggregated ClusterRoles and gain rules from it.
+// The rules of a changed aggregated ClusterRole are the rules of the ClusterRoles its aggregationRule selects.
+func (c *roleChange) widenedRoles(source RBACSource) ([]widenedRole, error) {
+	if c.namespace != "" {
+		added := util.NewRuleSet(c.rules...).Difference(util.NewRuleSet(c.oldRules...))
+		if added.IsEmpty() {
+			return nil, nil
+		}
+		return []widenedRole{{namespace: c.namespace, name: c.name, added: added}}, nil
+	}
+	clusterRoles, err := source.ListClusterRoles()
+	if err != nil {
+		return nil, err
+	}
+	rules := util.NewRuleSet(c.rules...)
+	if c.aggregationRule != nil {
+		rules = util.NewRuleSet()
+		for _, clusterRole := range clusterRoles {
+			if clusterRole.Name != c.name && selectsClusterRole(c.aggregationRule, clusterRole.Labels) {
+				rules.Add(clusterRole.Rules...)
+			}
+		}
+	}
+	var widened []widenedRole
+	if added := rules.Difference(util.NewRuleSet(c.oldRules...)); !added.IsEmpty() {
+		widened = append(widened, widenedRole{name: c.name, added: added})
+	}
+
+	// The aggregation controller copies the rules of the selected ClusterRoles, so aggregated ClusterRoles selecting an
+	// aggregated ClusterRole gain its new rules as well
+	type component struct {
+		labels map[string]string
+		rules  *util.RuleSet
+	}
+	visited := map[string]bool{c.name: true}
+	queue := []component{{labels: c.labels, rules: rules}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, clusterRole := range clusterRoles {
+			if visited[clusterRole.Name] || clusterRole.AggregationRule == nil || !selectsClusterRole(clusterRole.AggregationRule, current.labels) {
+				continue
+			}
+			added := current.rules.Difference(util.NewRuleSet(clusterRole.Rules...))
+			if added.IsEmpty() {
+				continue
+			}
+			visited[clusterRole.Name] = true
+			widened = append(widened, widenedRole{name: clusterRole.Name, added: added, aggregated: true})
+			queue = append(queue, component{labels: clusterRole.Labels, rules: util.NewRuleSet(clusterRole.Rules...).Union(added)})
+		}
+	}
+	return widened, nil
+}
+
+// selectsClusterRole reports if any selector of the aggregationRule matches the labels of a ClusterRole.
+// Invalid selectors are skipped like the aggregation controller does.
+func selectsClusterRole(aggregationRule *rbacv1.AggregationRule, clusterRoleLabels map[string]string) bool {
+	for _, selector := range aggregationRule.ClusterRoleSelectors {
+		selector := selector
+		labelSelector, err := metav1.LabelSelectorAsSelector(&selector)
+		if err != nil {
+			continue
+		}
+		if labelSelector.Matches(labels.Set(clusterRoleLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregatingRoleNames returns the names of the aggregated ClusterRoles widened through aggregation
+func aggregatingRoleNames(widened []widenedRole) []string {
+	var names []string
+	for _, role := range widened {
+		if role.aggregated {
+			names = append(names, role.name)
+		}
+	}
+	return names
+}
+
+// roleGrants are the ServiceAccounts a role is bound to and the scopes they hold its rules in
+type roleGrants struct {
+	// serviceAccounts as namespace/name, namespace/* stands for the ServiceAccount group of a namespace
+	serviceAccounts map[string]bool
+	namespaces      map[string]bool
+	clusterScope    bool
+}
+
+// affectedServiceAccounts returns the ServiceAccounts the existing bindings of the role grant its rules to
+func (r *widenedRole) affectedServiceAccounts(source RBACSource) (*roleGrants, error) {
+	grants := &roleGrants{serviceAccounts: make(map[string]bool), namespaces: make(map[string]bool)}
+	namespaces := []string{r.namespace}
+	if r.namespace == "" {
+		clusterRoleBindings, err := source.ListClusterRoleBindings()
+		if err != nil {
+			return nil, err
+		}
+		for _, clusterRoleBinding := range clusterRoleBindings {
+			if clusterRoleBinding.RoleRef.Kind == "ClusterRole" && clusterRoleBinding.RoleRef.Name == r.name && grants.add(clusterRoleBinding.Subjects, "") {
+				grants.clusterScope = true
+			}
+		}
+		namespaceObjects, err := source.ListNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = namespaces[:0]
+		for _, namespace := range namespaceObjects {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+	kind := "Role"
+	if r.namespace == "" {
+		kind = "ClusterRole"
+	}
+	for _, namespace := range namespaces {
+		roleBindings, err := source.ListRoleBindings(namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, roleBinding := range roleBindings {
+			if roleBinding.RoleRef.Kind == kind && roleBinding.RoleRef.Name == r.name && grants.add(roleBinding.Subjects, roleBinding.Namespace) {
+				grants.namespaces[roleBinding.Namespace] = true
+			}
+		}
+	}
+	return grants, nil
+}
+
+// add adds the ServiceAccount subjects of a binding in namespace and reports if there was any
+func (g *roleGrants) add(subjects []rbacv1.Subject, namespace string) bool {
+	added := false
+	for _, subject := range subjects {
+		switch {
+		case subject.Kind == rbacv1.ServiceAccountKind:
+			subjectNamespace := subject.Namespace
+			if subjectNamespace == "" {
+				subjectNamespace = namespace
+			}
+			g.serviceAccounts[subjectNamespace+"/"+subject.Name] = true
+			added = true
+		case subject.Kind == rbacv1.GroupKind && strings.HasPrefix(subject.Name, serviceaccount.ServiceAccountGroupPrefix):
+			g.serviceAccounts[strings.TrimPrefix(subject.Name, serviceaccount.ServiceAccountGroupPrefix)+"/*"] = true
+			added = true
+		case subject.Kind == rbacv1.GroupKind && subject.Name == serviceaccount.AllServiceAccountsGroup:
+			g.serviceAccounts["*/*"] = true
+			added = true
+		}
+	}
+	return added
+}
+
+// affectedPods returns the pods running as the ServiceAccounts as namespace/name. Pods of ServiceAccount groups are not listed.
+func affectedPods(serviceAccounts map[string]bool, source RBACSource) ([]string, error) {
+	var pods []string
+	for _, serviceAccount := range sortedNames(serviceAccounts) {
+		namespace, name, _ := strings.Cut(serviceAccount, "/")
+		if name == "*" {
+			continue
+		}
+		names, err := source.ServiceAccountPods(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range names {
+			pods = append(pods, namespace+"/"+pod)
+		}
+	}
+	return pods, nil
+}
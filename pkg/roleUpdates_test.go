@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestEvaluateRoleUpdate(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "build-1", Namespace: testNamespace}, Spec: corev1.PodSpec{ServiceAccountName: "builder"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: testNamespace}},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "admins", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "admin"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "admins"}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-viewer", Labels: map[string]string{"aggregate-to-operator": "true"}},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "operator", Labels: map[string]string{"aggregate-to-platform": "true"}},
+			AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+				{MatchLabels: map[string]string{"aggregate-to-operator": "true"}},
+			}},
+			Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "platform"},
+			AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+				{MatchLabels: map[string]string{"aggregate-to-platform": "true"}},
+			}},
+			Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-admin"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"*"}}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-admins"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "secret-admin"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "secret-admins"}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "operator", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "operator"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "operator", Namespace: testNamespace}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "platform"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "platform"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "platform", Namespace: testNamespace}},
+		},
+	)
+	podRules := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "create"}}}
+	widenedPodRules := append([]rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}}, podRules...)
+	role := func(name string, rules []rbacv1.PolicyRule) *rbacv1.Role {
+		return &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace}, Rules: rules}
+	}
+	secretReader := func(labels map[string]string, verbs ...string) *rbacv1.ClusterRole {
+		return &rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-reader", Labels: labels},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: verbs}},
+		}
+	}
+	aggregateToOperator := map[string]string{"aggregate-to-operator": "true"}
+	nodes := func(verbs ...string) *rbacv1.ClusterRole {
+		return &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "nodes"}, Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: verbs}}}
+	}
+	tests := []struct {
+		name      string
+		object    runtime.Object
+		oldObject runtime.Object
+		kind      string
+		groups    []string
+		allowed   bool
+		reason    string
+		bound     []string
+		pods      []string
+		warnings  int
+	}{
+		{
+			name:   "widening a role bound to a service account with rules not held by the requester is denied",
+			object: role("pods", widenedPodRules), oldObject: role("pods", podRules), kind: "Role",
+			reason: ReasonEscalation, bound: []string{"team/builder"}, pods: []string{"team/build-1"},
+		},
+		{
+			name:   "widening a role bound to a service account with rules held by the requester is allowed with a warning",
+			object: role("pods", widenedPodRules), oldObject: role("pods", podRules), kind: "Role", groups: []string{"admins"},
+			allowed: true, reason: ReasonAllowed, bound: []string{"team/builder"}, pods: []string{"team/build-1"}, warnings: 1,
+		},
+		{
+			name:   "narrowing a role is allowed",
+			object: role("pods", podRules[:0]), oldObject: role("pods", podRules), kind: "Role",
+			allowed: true, reason: ReasonAllowed,
+		},
+		{
+			name:   "creating a role without bindings is allowed",
+			object: role("unbound", widenedPodRules), kind: "Role",
+			allowed: true, reason: ReasonAllowed,
+		},
+		{
+			name:   "widening a cluster role bound to a service account is denied",
+			object: nodes("get", "list"), oldObject: nodes("get"), kind: "ClusterRole",
+			reason: ReasonEscalation, bound: []string{"team/node-reader"},
+		},
+		{
+			name: "aggregated cluster roles gain the rules of the selected cluster roles only",
+			object: &rbacv1.ClusterRole{
+				ObjectMeta:      metav1.ObjectMeta{Name: "nodes"},
+				AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: aggregateToOperator}}},
+				Rules:           []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+			},
+			oldObject: nodes("get"), kind: "ClusterRole",
+			reason: ReasonEscalation, bound: []string{"team/node-reader"},
+		},
+		{
+			name:   "labelling a cluster role for aggregation widens the aggregated cluster roles and is denied",
+			object: secretReader(aggregateToOperator, "get"), oldObject: secretReader(nil, "get"), kind: "ClusterRole",
+			reason: ReasonEscalation, bound: []string{"team/operator", "team/platform"},
+		},
+		{
+			name:   "widening a component of aggregated cluster roles with rules held by the requester is allowed with a warning",
+			object: secretReader(aggregateToOperator, "get", "list"), oldObject: secretReader(aggregateToOperator), kind: "ClusterRole", groups: []string{"secret-admins"},
+			allowed: true, reason: ReasonAllowed, bound: []string{"team/operator", "team/platform"}, warnings: 1,
+		},
+		{
+			name:   "widening a component of aggregated cluster roles with rules held by the requester in the namespace only is denied",
+			object: secretReader(aggregateToOperator, "get", "list"), oldObject: secretReader(aggregateToOperator), kind: "ClusterRole", groups: []string{"admins"},
+			reason: ReasonEscalation, bound: []string{"team/operator", "team/platform"},
+		},
+		{
+			name:   "creating an unlabelled cluster role is allowed",
+			object: secretReader(nil, "get"), kind: "ClusterRole",
+			allowed: true, reason: ReasonAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SaRbacValidatorConfig{Logger: zerolog.Nop(), Source: NewMemoryRBACSource(objects...)}
+
+			request := newTestAdmissionRequest(t, rbacv1.SchemeGroupVersion.WithKind(test.kind), test.object, test.oldObject)
+			request.UserInfo.Groups = append(test.groups, request.UserInfo.Groups...)
+
+			report := EvaluateRoleUpdate(context.Background(), request, config)
+			if report.Allowed != test.allowed || report.Reason != test.reason {
+				t.Errorf("expected allowed %t with reason %q, got %t with %q: %s", test.allowed, test.reason, report.Allowed, report.Reason, report.Message)
+			}
+			if !reflect.DeepEqual(report.BoundServiceAccounts, test.bound) {
+				t.Errorf("expected bound service accounts %v, got %v", test.bound, report.BoundServiceAccounts)
+			}
+			if !reflect.DeepEqual(report.AffectedPods, test.pods) {
+				t.Errorf("expected affected pods %v, got %v", test.pods, report.AffectedPods)
+			}
+			if len(report.Warnings) != test.warnings {
+				t.Errorf("expected %d warnings, got %v", test.warnings, report.Warnings)
+			}
+		})
+	}
+}
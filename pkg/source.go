@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/informers"
+	v1 "k8s.io/client-go/informers/core/v1"
+	rbacInformersv1 "k8s.io/client-go/informers/rbac/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RBACSource provides the RBAC objects and ServiceAccount identities the permissions of a subject are computed from
+type RBACSource interface {
+	// ListNamespaces returns all namespaces
+	ListNamespaces() ([]*corev1.Namespace, error)
+	// ListRoleBindings returns the RoleBindings of namespace
+	ListRoleBindings(namespace string) ([]*rbacv1.RoleBinding, error)
+	// ListClusterRoleBindings returns all ClusterRoleBindings
+	ListClusterRoleBindings() ([]*rbacv1.ClusterRoleBinding, error)
+	// RoleBindingsForSubject returns the RoleBindings of all namespaces with a subject matching subject
+	RoleBindingsForSubject(subject user.Info) ([]*rbacv1.RoleBinding, error)
+	// ClusterRoleBindingsForSubject returns the ClusterRoleBindings with a subject matching subject
+	ClusterRoleBindingsForSubject(subject user.Info) ([]*rbacv1.ClusterRoleBinding, error)
+	// BoundServiceAccounts returns the names of the ServiceAccounts of namespace that are subjects of any binding
+	BoundServiceAccounts(namespace string) ([]string, error)
+	// ServiceAccountTokenSecrets returns the ServiceAccount names of the legacy token Secrets of namespace by Secret name
+	ServiceAccountTokenSecrets(namespace string) (map[string]string, error)
+	// ServiceAccountPods returns the names of the pods of namespace running as serviceAccount, none if pods are not watched
+	ServiceAccountPods(namespace string, serviceAccount string) ([]string, error)
+	// GetPodServiceAccount returns the name of the ServiceAccount the pod name in namespace runs as or a NotFound error
+	GetPodServiceAccount(namespace string, name string) (string, error)
+	// GetRole returns the Role name in namespace or a NotFound error
+	GetRole(namespace string, name string) (*rbacv1.Role, error)
+	// GetClusterRole returns the ClusterRole name or a NotFound error
+	GetClusterRole(name string) (*rbacv1.ClusterRole, error)
+	// ListClusterRoles returns all ClusterRoles
+	ListClusterRoles() ([]*rbacv1.ClusterRole, error)
+	// GetServiceAccount returns the user.Info the ServiceAccount name in namespace authenticates as
+	GetServiceAccount(name string, namespace string) (user.Info, error)
+}
+
+// InformerRBACSource serves the RBAC objects from informer caches and resolves ServiceAccounts with TokenRequests and TokenReviews
+type InformerRBACSource struct {
+	Client                     kubernetes.Interface
+	ClusterRoleBindingInformer rbacInformersv1.ClusterRoleBindingInformer
+	RoleBindingInformer        rbacInformersv1.RoleBindingInformer
+	ClusterRoleInformer        rbacInformersv1.ClusterRoleInformer
+	RoleInformer               rbacInformersv1.RoleInformer
+	NamespaceInformer          v1.NamespaceInformer
+	// TokenSecretInformer watches the metadata of legacy ServiceAccount token Secrets, nil unless WatchTokenSecrets is called
+	TokenSecretInformer informers.GenericInformer
+	// PodInformer watches the ServiceAccounts of pods, nil unless WatchPods is called
+	PodInformer v1.PodInformer
+}
+
+// NewInformerRBACSource creates the informers of the source in factory and indexes the bindings by subject.
+// The factory has to be started afterwards.
+func NewInformerRBACSource(client kubernetes.Interface, factory informers.SharedInformerFactory) (*InformerRBACSource, error) {
+	source := &InformerRBACSource{
+		Client:                     client,
+		ClusterRoleBindingInformer: factory.Rbac().V1().ClusterRoleBindings(),
+		RoleBindingInformer:        factory.Rbac().V1().RoleBindings(),
+		ClusterRoleInformer:        factory.Rbac().V1().ClusterRoles(),
+		RoleInformer:               factory.Rbac().V1().Roles(),
+		NamespaceInformer:          factory.Core().V1().Namespaces(),
+	}
+	// Informer registers the informer with the factory so it is started by factory.Start
+	for _, informer := range source.informers() {
+		informer.Informer()
+	}
+	if err := source.RoleBindingInformer.Informer().AddIndexers(roleBindingIndexers); err != nil {
+		return nil, err
+	}
+	if err := source.ClusterRoleBindingInformer.Informer().AddIndexers(clusterRoleBindingIndexers); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// sharedInformer is implemented by every typed informer
+type sharedInformer interface {
+	Informer() cache.SharedIndexInformer
+}
+
+func (s *InformerRBACSource) informers() []sharedInformer {
+	sharedInformers := []sharedInformer{
+		s.ClusterRoleBindingInformer,
+		s.RoleBindingInformer,
+		s.ClusterRoleInformer,
+		s.RoleInformer,
+		s.NamespaceInformer,
+	}
+	if s.TokenSecretInformer != nil {
+		sharedInformers = append(sharedInformers, s.TokenSecretInformer)
+	}
+	if s.PodInformer != nil {
+		sharedInformers = append(sharedInformers, s.PodInformer)
+	}
+	return sharedInformers
+}
+
+// InformersSynced returns the HasSynced functions of all informers of the source
+func (s *InformerRBACSource) InformersSynced() []cache.InformerSynced {
+	var synced []cache.InformerSynced
+	for _, informer := range s.informers() {
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	return synced
+}
+
+func (s *InformerRBACSource) ListNamespaces() ([]*corev1.Namespace, error) {
+	return s.NamespaceInformer.Lister().List(labels.Everything())
+}
+
+func (s *InformerRBACSource) ListRoleBindings(namespace string) ([]*rbacv1.RoleBinding, error) {
+	return s.RoleBindingInformer.Lister().RoleBindings(namespace).List(labels.Everything())
+}
+
+func (s *InformerRBACSource) ListClusterRoleBindings() ([]*rbacv1.ClusterRoleBinding, error) {
+	return s.ClusterRoleBindingInformer.Lister().List(labels.Everything())
+}
+
+func (s *InformerRBACSource) RoleBindingsForSubject(subject user.Info) ([]*rbacv1.RoleBinding, error) {
+	return indexedRoleBindings(s.RoleBindingInformer.Informer().GetIndexer(), subject)
+}
+
+func (s *InformerRBACSource) ClusterRoleBindingsForSubject(subject user.Info) ([]*rbacv1.ClusterRoleBinding, error) {
+	return indexedClusterRoleBindings(s.ClusterRoleBindingInformer.Informer().GetIndexer(), subject)
+}
+
+func (s *InformerRBACSource) BoundServiceAccounts(namespace string) ([]string, error) {
+	return boundServiceAccounts(namespace, s.RoleBindingInformer.Informer().GetIndexer(), s.ClusterRoleBindingInformer.Informer().GetIndexer())
+}
+
+func (s *InformerRBACSource) GetRole(namespace string, name string) (*rbacv1.Role, error) {
+	return s.RoleInformer.Lister().Roles(namespace).Get(name)
+}
+
+func (s *InformerRBACSource) GetClusterRole(name string) (*rbacv1.ClusterRole, error) {
+	return s.ClusterRoleInformer.Lister().Get(name)
+}
+
+func (s *InformerRBACSource) ListClusterRoles() ([]*rbacv1.ClusterRole, error) {
+	return s.ClusterRoleInformer.Lister().List(labels.Everything())
+}
+
+func (s *InformerRBACSource) GetServiceAccount(name string, namespace string) (user.Info, error) {
+	return util.GetServiceAccount(s.Client, name, namespace)
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"sort"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/tools/cache"
+)
+
+// subjectIndex is the name of the index of RoleBindings and ClusterRoleBindings by the keys of their subjects.
+// The informers update the index with every event, so looking up the bindings of a subject never scans all bindings.
+const subjectIndex = "subject"
+
+// serviceAccountNamespaceIndex is the name of the index of bindings by the namespaces of their ServiceAccount subjects
+const serviceAccountNamespaceIndex = "serviceAccountNamespace"
+
+var roleBindingIndexers = cache.Indexers{
+	subjectIndex: func(obj interface{}) ([]string, error) {
+		roleBinding, ok := obj.(*rbacv1.RoleBinding)
+		if !ok {
+			return nil, nil
+		}
+		return subjectKeys(roleBinding.Subjects, roleBinding.Namespace), nil
+	},
+	serviceAccountNamespaceIndex: func(obj interface{}) ([]string, error) {
+		roleBinding, ok := obj.(*rbacv1.RoleBinding)
+		if !ok {
+			return nil, nil
+		}
+		return serviceAccountNamespaces(roleBinding.Subjects, roleBinding.Namespace), nil
+	},
+}
+
+var clusterRoleBindingIndexers = cache.Indexers{
+	subjectIndex: func(obj interface{}) ([]string, error) {
+		clusterRoleBinding, ok := obj.(*rbacv1.ClusterRoleBinding)
+		if !ok {
+			return nil, nil
+		}
+		return subjectKeys(clusterRoleBinding.Subjects, ""), nil
+	},
+	serviceAccountNamespaceIndex: func(obj interface{}) ([]string, error) {
+		clusterRoleBinding, ok := obj.(*rbacv1.ClusterRoleBinding)
+		if !ok {
+			return nil, nil
+		}
+		return serviceAccountNamespaces(clusterRoleBinding.Subjects, ""), nil
+	},
+}
+
+// serviceAccountNamespaces returns the namespaces of the ServiceAccount subjects of a binding in namespace
+func serviceAccountNamespaces(subjects []rbacv1.Subject, namespace string) []string {
+	var namespaces []string
+	for _, subject := range subjects {
+		if subject.Kind != rbacv1.ServiceAccountKind {
+			continue
+		}
+		subjectNamespace := subject.Namespace
+		if subjectNamespace == "" {
+			subjectNamespace = namespace
+		}
+		namespaces = append(namespaces, subjectNamespace)
+	}
+	return namespaces
+}
+
+// boundServiceAccounts returns the sorted names of the ServiceAccounts of namespace that are subjects of a binding of any indexer
+func boundServiceAccounts(namespace string, indexers ...cache.Indexer) ([]string, error) {
+	names := make(map[string]bool)
+	for _, indexer := range indexers {
+		objects, err := indexer.ByIndex(serviceAccountNamespaceIndex, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			var subjects []rbacv1.Subject
+			bindingNamespace := ""
+			switch binding := object.(type) {
+			case *rbacv1.RoleBinding:
+				subjects = binding.Subjects
+				bindingNamespace = binding.Namespace
+			case *rbacv1.ClusterRoleBinding:
+				subjects = binding.Subjects
+			}
+			for _, subject := range subjects {
+				if subject.Kind != rbacv1.ServiceAccountKind {
+					continue
+				}
+				if subject.Namespace == namespace || (subject.Namespace == "" && bindingNamespace == namespace) {
+					names[subject.Name] = true
+				}
+			}
+		}
+	}
+	return sortedNames(names), nil
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func subjectKeys(subjects []rbacv1.Subject, namespace string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, subject := range subjects {
+		key := util.SubjectKey(subject, namespace)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// indexedBindings returns the objects of indexer bound to any subject matching the user, ordered by their key
+func indexedBindings(indexer cache.Indexer, subject user.Info) ([]interface{}, error) {
+	byKey := make(map[string]interface{})
+	for _, subjectKey := range util.UserSubjectKeys(subject) {
+		objects, err := indexer.ByIndex(subjectIndex, subjectKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			key, err := cache.MetaNamespaceKeyFunc(object)
+			if err != nil {
+				return nil, err
+			}
+			byKey[key] = object
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	objects := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, byKey[key])
+	}
+	return objects, nil
+}
+
+func indexedRoleBindings(indexer cache.Indexer, subject user.Info) ([]*rbacv1.RoleBinding, error) {
+	objects, err := indexedBindings(indexer, subject)
+	if err != nil {
+		return nil, err
+	}
+	roleBindings := make([]*rbacv1.RoleBinding, 0, len(objects))
+	for _, object := range objects {
+		roleBindings = append(roleBindings, object.(*rbacv1.RoleBinding))
+	}
+	return roleBindings, nil
+}
+
+func indexedClusterRoleBindings(indexer cache.Indexer, subject user.Info) ([]*rbacv1.ClusterRoleBinding, error) {
+	objects, err := indexedBindings(indexer, subject)
+	if err != nil {
+		return nil, err
+	}
+	clusterRoleBindings := make([]*rbacv1.ClusterRoleBinding, 0, len(objects))
+	for _, object := range objects {
+		clusterRoleBindings = append(clusterRoleBindings, object.(*rbacv1.ClusterRoleBinding))
+	}
+	return clusterRoleBindings, nil
+}
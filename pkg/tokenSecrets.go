@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// tokenSecretFieldSelector selects the legacy ServiceAccount token Secrets, the only Secrets the validator looks at
+var tokenSecretFieldSelector = fields.OneTermEqualSelector("type", string(corev1.SecretTypeServiceAccountToken)).String()
+
+var errTokenSecretsNotWatched = errors.New("ServiceAccount token Secrets are not watched")
+
+// TokenSecretInformerFactory runs the metadata informer of the legacy ServiceAccount token Secrets.
+// Only the metadata is watched, the tokens never reach the validator.
+type TokenSecretInformerFactory struct {
+	informer informers.GenericInformer
+	start    sync.Once
+	running  sync.WaitGroup
+}
+
+// NewTokenSecretInformerFactory creates the token Secret informer, it is started with Start
+func NewTokenSecretInformerFactory(client metadata.Interface) *TokenSecretInformerFactory {
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	return &TokenSecretInformerFactory{
+		informer: metadatainformer.NewFilteredMetadataInformer(client, corev1.SchemeGroupVersion.WithResource("secrets"), "", 0, indexers, func(options *metav1.ListOptions) {
+			options.FieldSelector = tokenSecretFieldSelector
+		}),
+	}
+}
+
+// Start runs the informer until stopCh is closed, later calls do nothing
+func (f *TokenSecretInformerFactory) Start(stopCh <-chan struct{}) {
+	f.start.Do(func() {
+		f.running.Add(1)
+		go func() {
+			defer f.running.Done()
+			f.informer.Informer().Run(stopCh)
+		}()
+	})
+}
+
+// Shutdown blocks until the informer stopped, like Shutdown of the typed informer factories
+func (f *TokenSecretInformerFactory) Shutdown() {
+	f.running.Wait()
+}
+
+// WatchTokenSecrets adds the token Secret informer of factory to the source.
+// The factory has to be started afterwards.
+func (s *InformerRBACSource) WatchTokenSecrets(factory *TokenSecretInformerFactory) {
+	s.TokenSecretInformer = factory.informer
+}
+
+func (s *InformerRBACSource) ServiceAccountTokenSecrets(namespace string) (map[string]string, error) {
+	if s.TokenSecretInformer == nil {
+		return nil, errTokenSecretsNotWatched
+	}
+	return tokenSecretServiceAccounts(s.TokenSecretInformer.Informer().GetIndexer(), namespace)
+}
+
+// tokenSecretServiceAccounts returns the ServiceAccount names of the token Secrets of namespace by Secret name
+func tokenSecretServiceAccounts(indexer cache.Indexer, namespace string) (map[string]string, error) {
+	objects, err := indexer.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccounts := make(map[string]string, len(objects))
+	for _, object := range objects {
+		secret, ok := object.(metav1.Object)
+		if !ok {
+			continue
+		}
+		if serviceAccount := secret.GetAnnotations()[corev1.ServiceAccountNameKey]; serviceAccount != "" {
+			serviceAccounts[secret.GetName()] = serviceAccount
+		}
+	}
+	return serviceAccounts, nil
+}
+
+// tokenSecretMetadata returns the Secret without its data if it is a legacy ServiceAccount token Secret
+func tokenSecretMetadata(secret *corev1.Secret) (*corev1.Secret, bool) {
+	if secret.Type != corev1.SecretTypeServiceAccountToken {
+		return nil, false
+	}
+	return &corev1.Secret{ObjectMeta: secret.ObjectMeta, Type: secret.Type}, true
+}
+
+// SnapshotTokenSecrets lists the metadata of the legacy ServiceAccount token Secrets of a live cluster
+func SnapshotTokenSecrets(ctx context.Context, client metadata.Interface) ([]runtime.Object, error) {
+	secrets, err := client.Resource(corev1.SchemeGroupVersion.WithResource("secrets")).List(ctx, metav1.ListOptions{FieldSelector: tokenSecretFieldSelector})
+	if err != nil {
+		return nil, errors.New("Failed to list token Secrets: " + err.Error())
+	}
+	var objects []runtime.Object
+	for _, secret := range secrets.Items {
+		objects = append(objects, &corev1.Secret{ObjectMeta: secret.ObjectMeta, Type: corev1.SecretTypeServiceAccountToken})
+	}
+	return objects, nil
+}
+
+// tokenSecretServiceAccountNames returns the sorted ServiceAccount names of the token Secrets in names, or of all if names is nil
+func tokenSecretServiceAccountNames(tokenSecrets map[string]string, names []string) []string {
+	serviceAccounts := make(map[string]bool)
+	if names == nil {
+		for _, serviceAccount := range tokenSecrets {
+			serviceAccounts[serviceAccount] = true
+		}
+	}
+	for _, name := range names {
+		if serviceAccount, ok := tokenSecrets[name]; ok {
+			serviceAccounts[serviceAccount] = true
+		}
+	}
+	return sortedNames(serviceAccounts)
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/flyingdogfood/sa-rbac-validator")
+
+// Tracer returns the tracer used for all spans of the validator. Spans are dropped as long as SetupTracing was not called.
+func Tracer() trace.Tracer {
+	return tracer
+}
+
+// RequestUIDAttribute is added to every span of a validation
+func RequestUIDAttribute(uid string) attribute.KeyValue {
+	return attribute.String("admission.request.uid", uid)
+}
+
+// endSpan records err on span if set and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetupTracing configures the global tracer provider to export spans via OTLP/HTTP to endpoint (host:port).
+// The returned function flushes and stops the exporter.
+func SetupTracing(ctx context.Context, endpoint string, insecure bool, logger zerolog.Logger) (func(context.Context) error, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("sa-rbac-validator"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error().Err(err).Msg("OpenTelemetry error")
+	}))
+	return tracerProvider.Shutdown, nil
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"strings"
+
+	util "github.com/flyingdogfood/sa-rbac-validator/util"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// maxTransitiveIdentities bounds the number of ServiceAccounts visited by the transitive analysis
+const maxTransitiveIdentities = 256
+
+// workloadResources run pods with any ServiceAccount of their namespace when created
+var workloadResources = []struct {
+	apiGroup string
+	resource string
+}{
+	{"", "pods"},
+	{"", "replicationcontrollers"},
+	{"apps", "deployments"},
+	{"apps", "replicasets"},
+	{"apps", "statefulsets"},
+	{"apps", "daemonsets"},
+	{"batch", "jobs"},
+	{"batch", "cronjobs"},
+}
+
+// canCreateWorkloads reports if rules allow to create any workload, which can run with any ServiceAccount of the namespace
+func canCreateWorkloads(rules *util.RuleSet) bool {
+	for _, workload := range workloadResources {
+		if rules.Allows(workload.apiGroup, workload.resource, "", "create") {
+			return true
+		}
+	}
+	return false
+}
+
+// transitiveClosure are the permissions of a ServiceAccount and of all ServiceAccounts it can act as
+type transitiveClosure struct {
+	namespaced map[string][]rbacv1.PolicyRule
+	cluster    []rbacv1.PolicyRule
+	// reachable are the ServiceAccounts the identities can act as, as namespace/name. namespace/* stands for all ServiceAccounts of the namespace.
+	reachable []string
+	truncated bool
+}
+
+// secretReadVerbs expose the token of a legacy ServiceAccount token Secret
+var secretReadVerbs = []string{"get", "list", "watch"}
+
+// reach are the ServiceAccounts of a namespace rules allow to act as
+type reach struct {
+	// all ServiceAccounts through creating any token, running workloads or reading any Secret if token Secrets are not watched
+	all bool
+	// serviceAccounts are the names of the ServiceAccounts rules allow to create tokens for
+	serviceAccounts []string
+	// allTokenSecrets are readable, so all ServiceAccounts with a legacy token Secret are reached
+	allTokenSecrets bool
+	// tokenSecrets are the names of the readable Secrets, reaching their ServiceAccount if they are token Secrets
+	tokenSecrets []string
+}
+
+func (r reach) isEmpty() bool {
+	return !r.all && len(r.serviceAccounts) == 0 && !r.allTokenSecrets && len(r.tokenSecrets) == 0
+}
+
+// reachOf returns the ServiceAccounts rules allow to act as. Token and workload creation is only followed with
+// TransitiveAnalysis. Secret reads reach the ServiceAccounts of the watched token Secrets with LegacyTokenAnalysis
+// and otherwise all ServiceAccounts.
+func reachOf(rules *util.RuleSet, saRbacValidatorConfig SaRbacValidatorConfig) reach {
+	var result reach
+	if saRbacValidatorConfig.TransitiveAnalysis {
+		if rules.Allows("", "serviceaccounts/token", "", "create") || canCreateWorkloads(rules) {
+			return reach{all: true}
+		}
+		result.serviceAccounts = rules.AllowedNames("", "serviceaccounts/token", "create")
+	}
+	if !saRbacValidatorConfig.LegacyTokenAnalysis {
+		if saRbacValidatorConfig.TransitiveAnalysis {
+			for _, verb := range secretReadVerbs {
+				if rules.Allows("", "secrets", "", verb) {
+					return reach{all: true}
+				}
+			}
+		}
+		return result
+	}
+	secretNames := make(map[string]bool)
+	for _, verb := range secretReadVerbs {
+		if rules.Allows("", "secrets", "", verb) {
+			result.allTokenSecrets = true
+			return result
+		}
+		for _, name := range rules.AllowedNames("", "secrets", verb) {
+			secretNames[name] = true
+		}
+	}
+	if len(secretNames) > 0 {
+		result.tokenSecrets = sortedNames(secretNames)
+	}
+	return result
+}
+
+// reachableInNamespace returns the identities of namespace reach allows to act as
+func reachableInNamespace(namespace string, r reach, source RBACSource) ([]user.Info, error) {
+	if r.all {
+		return namespaceServiceAccounts(namespace, source)
+	}
+	names := r.serviceAccounts
+	if r.allTokenSecrets || len(r.tokenSecrets) > 0 {
+		tokenSecrets, err := source.ServiceAccountTokenSecrets(namespace)
+		if err != nil {
+			return nil, err
+		}
+		if r.allTokenSecrets {
+			names = append(names, tokenSecretServiceAccountNames(tokenSecrets, nil)...)
+		} else {
+			names = append(names, tokenSecretServiceAccountNames(tokenSecrets, r.tokenSecrets)...)
+		}
+	}
+	identities := make([]user.Info, 0, len(names))
+	for _, name := range names {
+		identities = append(identities, util.ServiceAccountUser(name, namespace))
+	}
+	return identities, nil
+}
+
+// namespaceServiceAccounts returns the user.Info of all ServiceAccounts of namespace that can hold permissions of their own
+// and of an unnamed ServiceAccount standing for all others, which only holds the permissions of the ServiceAccount groups
+func namespaceServiceAccounts(namespace string, source RBACSource) ([]user.Info, error) {
+	identities := []user.Info{&user.DefaultInfo{
+		Name:   "",
+		Groups: append(serviceaccount.MakeGroupNames(namespace), user.AllAuthenticated),
+	}}
+	names, err := source.BoundServiceAccounts(namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		identities = append(identities, util.ServiceAccountUser(name, namespace))
+	}
+	return identities, nil
+}
+
+// identityName returns namespace/name of a ServiceAccount or namespace/* for the unnamed ServiceAccount
+func identityName(identity user.Info) string {
+	if namespace, name, err := serviceaccount.SplitUsername(identity.GetName()); err == nil {
+		return namespace + "/" + name
+	}
+	for _, group := range identity.GetGroups() {
+		if strings.HasPrefix(group, serviceaccount.ServiceAccountGroupPrefix) {
+			return strings.TrimPrefix(group, serviceaccount.ServiceAccountGroupPrefix) + "/*"
+		}
+	}
+	return identity.GetName()
+}
+
+// GetTransitivePermissions returns the union of the permissions of the identities and of every ServiceAccount they can act as,
+// following token creation, workload creation and Secret reads as configured until no new ServiceAccount is reached
+func GetTransitivePermissions(identities []user.Info, saRbacValidatorConfig SaRbacValidatorConfig) (*transitiveClosure, error) {
+	closure := &transitiveClosure{}
+	namespaced := make(map[string]*util.RuleSet)
+	cluster := util.NewRuleSet()
+	visited := make(map[string]bool)
+	for _, identity := range identities {
+		visited[identityName(identity)] = true
+	}
+	queue := append([]user.Info{}, identities...)
+	var allNamespaces []string
+
+	for len(queue) > 0 {
+		identity := queue[0]
+		queue = queue[1:]
+		namespacedRules, err := GetNamespacedPermissions(identity, saRbacValidatorConfig)
+		if err != nil {
+			return nil, err
+		}
+		clusterRules, err := GetClusterPermissions(identity, saRbacValidatorConfig)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Add(clusterRules...)
+		for namespace, rules := range namespacedRules {
+			if namespaced[namespace] == nil {
+				namespaced[namespace] = util.NewRuleSet()
+			}
+			namespaced[namespace].Add(rules...)
+		}
+
+		// Permissions at cluster scope apply to every namespace
+		clusterRuleSet := util.NewRuleSet(clusterRules...)
+		namespaces := make([]string, 0, len(namespacedRules))
+		for namespace := range namespacedRules {
+			namespaces = append(namespaces, namespace)
+		}
+		if !reachOf(clusterRuleSet, saRbacValidatorConfig).isEmpty() {
+			if allNamespaces == nil {
+				namespaceObjects, err := saRbacValidatorConfig.Source.ListNamespaces()
+				if err != nil {
+					return nil, err
+				}
+				allNamespaces = make([]string, 0, len(namespaceObjects))
+				for _, namespace := range namespaceObjects {
+					allNamespaces = append(allNamespaces, namespace.Name)
+				}
+			}
+			namespaces = allNamespaces
+		}
+
+		for _, namespace := range namespaces {
+			r := reachOf(util.NewRuleSet(namespacedRules[namespace]...).Union(clusterRuleSet), saRbacValidatorConfig)
+			if r.isEmpty() {
+				continue
+			}
+			reached, err := reachableInNamespace(namespace, r, saRbacValidatorConfig.Source)
+			if err != nil {
+				return nil, err
+			}
+			for _, next := range reached {
+				name := identityName(next)
+				if visited[name] {
+					continue
+				}
+				if len(visited) >= maxTransitiveIdentities {
+					closure.truncated = true
+					continue
+				}
+				visited[name] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	closure.namespaced = make(map[string][]rbacv1.PolicyRule)
+	for namespace, rules := range namespaced {
+		if !rules.IsEmpty() {
+			closure.namespaced[namespace] = rules.Rules()
+		}
+	}
+	closure.cluster = cluster.Rules()
+	for _, identity := range identities {
+		delete(visited, identityName(identity))
+	}
+	if len(visited) > 0 {
+		closure.reachable = sortedNames(visited)
+	}
+	return closure, nil
+}
@@ -1,32 +1,34 @@
 package pkg
 
 import (
-	"errors"
-	"net/http"
-	"strings"
+	"context"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	util "github.com/flyingdogfood/sa-rbac-validator/util"
 	admissionv1 "k8s.io/api/admission/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	v1 "k8s.io/client-go/informers/core/v1"
-	rbacInformersv1 "k8s.io/client-go/informers/rbac/v1"
-	"k8s.io/client-go/kubernetes"
 )
 
 type SaRbacValidatorConfig struct {
-	Logger                     zerolog.Logger
-	Client                     kubernetes.Clientset
-	ClusterRoleBindingInformer rbacInformersv1.ClusterRoleBindingInformer
-	RoleBindingInformer        rbacInformersv1.RoleBindingInformer
-	ClusterRoleInformer        rbacInformersv1.ClusterRoleInformer
-	RoleInformer               rbacInformersv1.RoleInformer
-	NamespaceInformer          v1.NamespaceInformer
-	ServiceAccountJsonPointer  string
-	SaNotFoundBehavior         int
+	Logger zerolog.Logger
+	Source RBACSource
+	// PermissionCache caches the permissions computed from Source if set
+	PermissionCache           *PermissionCache
+	ServiceAccountJsonPointer string
+	SaNotFoundBehavior        int
+	// DenyCriticalPermissions denies ServiceAccounts holding escalate, bind or impersonate unless the requester is exempted
+	DenyCriticalPermissions      bool
+	CriticalPermissionExemptions CriticalPermissionExemptions
+	// TransitiveAnalysis compares the permissions of all ServiceAccounts reachable from the ServiceAccount instead of its own
+	TransitiveAnalysis bool
+	// LegacyTokenAnalysis adds the permissions of the ServiceAccounts whose legacy token Secrets the ServiceAccount can read.
+	// The Source has to serve the token Secrets.
+	LegacyTokenAnalysis bool
 }
 
 const (
@@ -35,233 +37,214 @@ const (
 )
 
 func PraseNotFoundBehavior(behavior string) (int, error) {
-	behaviorLower := strings.ToLower(behavior)
-	if behaviorLower == "deny" {
-		return Deny, nil
+	return parseBehavior("saNotFoundBehavior", behavior)
+}
+
+func Validate(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	report := Evaluate(ctx, request, saRbacValidatorConfig)
+	return recordDecision(request, report, start)
+}
+
+// recordDecision records the metrics of the report and converts it to the AdmissionResponse
+func recordDecision(request *admissionv1.AdmissionRequest, report *Report, start time.Time) *admissionv1.AdmissionResponse {
+	validationDuration.Observe(time.Since(start).Seconds())
+
+	decision := "deny"
+	if report.Allowed {
+		decision = "allow"
 	}
-	if behaviorLower == "allow" {
-		return Allow, nil
+	admissionDecisions.WithLabelValues(request.Kind.Group, request.Kind.Version, request.Kind.Kind, request.Namespace, decision, report.Reason).Inc()
+	return report.Response(request)
+}
+
+func observePhase(phase string, start time.Time) {
+	validationPhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// Evaluate compares the permissions of the ServiceAccount referenced by the request with the permissions of the requester
+func Evaluate(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *Report {
+	extractServiceAccount := func(request *admissionv1.AdmissionRequest) (string, error) {
+		return util.ExtractServiceAccount(request, saRbacValidatorConfig.ServiceAccountJsonPointer)
 	}
-	return -1, errors.New("Faild to phrase behavior. Behavior: " + behavior + " invalid")
+	return evaluate(ctx, request, saRbacValidatorConfig, extractServiceAccount, true)
 }
 
-func Validate(request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig) *admissionv1.AdmissionResponse {
+// serviceAccountLookup returns the name of the ServiceAccount in the namespace of the request the request acts as
+type serviceAccountLookup func(request *admissionv1.AdmissionRequest) (string, error)
+
+// evaluate compares the permissions of the ServiceAccount returned by lookup with the permissions of the requester.
+// The tokens of the pod are only inspected with inspectPodSpec, as the object of the request has to contain the PodSpec.
+func evaluate(ctx context.Context, request *admissionv1.AdmissionRequest, saRbacValidatorConfig SaRbacValidatorConfig, lookup serviceAccountLookup, inspectPodSpec bool) *Report {
 	logger := saRbacValidatorConfig.Logger.With().Str("Request UID", string(request.UID)).Logger()
 	logger.Info().Msg("Start Validating Request")
+	phaseStart := time.Now()
 	//Extract user from reqeust to later compare it's permissions to the service acount
 	user := util.ExtractUser(request)
 	logger.Info().Str("UserName", user.GetName()).Str("UserUID", user.GetUID()).Strs("UserGroups", user.GetGroups())
+	report := newReport(request)
 
 	//Extract service account name from admission request
-	serviceAccount, err := util.ExtractServiceAccount(request, saRbacValidatorConfig.ServiceAccountJsonPointer)
+	serviceAccount, err := lookup(request)
+	observePhase(PhaseExtract, phaseStart)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to extract ServiceAccount")
 		if saRbacValidatorConfig.SaNotFoundBehavior == Deny {
 			logger.Info().Msg("Request denied")
-			return &admissionv1.AdmissionResponse{
-				UID:     request.UID,
-				Allowed: false,
-				Result: &metav1.Status{
-					Message: err.Error(),
-					Code:    http.StatusForbidden,
-				},
-			}
+			return report.deny(ReasonSaNotFound, err.Error())
 		}
 		logger.Info().Msg("Request allowed")
-		return &admissionv1.AdmissionResponse{
-			UID:     request.UID,
-			Allowed: true,
-			Result: &metav1.Status{
-				Message: err.Error(),
-				Code:    http.StatusOK,
-			},
-		}
+		return report.allow(ReasonSaNotFound, err.Error())
 	}
 	logger.Info().Str("ServiceAccountName", serviceAccount)
+	report.ServiceAccount = serviceAccount
 
 	// Create the user.Info struct for the service account as we are using this to get all the associated roles of the serviceaccount
-	serviceAccountUser, err := util.GetServiceAccount(&saRbacValidatorConfig.Client, serviceAccount, request.Namespace)
+	phaseStart = time.Now()
+	_, span := tracer.Start(ctx, "ResolveServiceAccount", trace.WithAttributes(RequestUIDAttribute(string(request.UID)), attribute.String("serviceaccount.name", serviceAccount)))
+	serviceAccountUser, err := saRbacValidatorConfig.Source.GetServiceAccount(serviceAccount, request.Namespace)
+	observePhase(PhaseIdentity, phaseStart)
+	endSpan(span, err)
 	if err != nil {
+		recordApiCallError(err)
 		logger.Error().Err(err).Msg("Failed to get ServiceAccount User")
-		return &admissionv1.AdmissionResponse{
-			UID:     request.UID,
-			Allowed: false,
-			Result: &metav1.Status{
-				Message: err.Error(),
-				Code:    http.StatusForbidden,
-			},
-		}
+		return report.deny(ReasonIdentityError, err.Error())
 	}
 	logger.Info().Str("ServiceAccountName", serviceAccountUser.GetName()).Str("ServiceAccountNamespace", request.Namespace).Str("ServiceAccountUID", serviceAccountUser.GetUID()).Strs("ServiceAccountGroups", serviceAccountUser.GetGroups())
 
-	namespaces, err := saRbacValidatorConfig.NamespaceInformer.Lister().List(labels.Everything())
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to list namespaces")
-		return &admissionv1.AdmissionResponse{
-			UID:     request.UID,
-			Allowed: false,
-			Result: &metav1.Status{
-				Message: err.Error(),
-				Code:    http.StatusForbidden,
-			},
+	// Pods obtain the token of their ServiceAccount unless disabled and the tokens of the legacy token Secrets they reference
+	tokens, isPod := &podTokens{}, false
+	if inspectPodSpec {
+		tokens, isPod, err = extractPodTokens(request, saRbacValidatorConfig)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to inspect PodSpec")
+			return report.deny(ReasonPodSpecError, err.Error())
 		}
 	}
+	if !isPod {
+		tokens = &podTokens{ownToken: true}
+	}
+	identities, tokenServiceAccounts := tokens.identities(serviceAccountUser, serviceAccount, request.Namespace)
+	report.TokenServiceAccounts = tokenServiceAccounts
+	if len(identities) == 0 {
+		logger.Info().Msg("Request allowed")
+		return report.allow(ReasonAllowed, "Pod obtains no ServiceAccount token")
+	}
 
-	isEscalated := false
-	namespacedEscalationRules := make(map[string][]rbacv1.PolicyRule)
-
-	for _, namespace := range namespaces {
-		logger.Info().Str("Processing Namespace", namespace.Name)
-		var saRules []rbacv1.PolicyRule
-		var userRules []rbacv1.PolicyRule
-		roleBindings, err := saRbacValidatorConfig.RoleBindingInformer.Lister().RoleBindings(namespace.Name).List(labels.Everything())
+	var saNamespacedRules map[string][]rbacv1.PolicyRule
+	var saClusterRules []rbacv1.PolicyRule
+	followIdentities := saRbacValidatorConfig.TransitiveAnalysis || saRbacValidatorConfig.LegacyTokenAnalysis || len(identities) != 1 || !tokens.ownToken
+	if followIdentities {
+		phaseStart = time.Now()
+		_, span = tracer.Start(ctx, "TransitiveClosure", trace.WithAttributes(RequestUIDAttribute(string(request.UID))))
+		closure, err := GetTransitivePermissions(identities, saRbacValidatorConfig)
+		observePhase(PhaseTransitive, phaseStart)
 		if err != nil {
-			return &admissionv1.AdmissionResponse{
-				UID:     request.UID,
-				Allowed: false,
-				Result: &metav1.Status{
-					Message: err.Error(),
-					Code:    http.StatusForbidden,
-				},
-			}
-		}
-		for _, roleBinding := range roleBindings {
-			logger.Info().Str("Processing RoleBinding", roleBinding.Name)
-			if util.SubjectsMatchesUserOrServiceAccount(roleBinding.Subjects, serviceAccountUser, roleBinding.Namespace) {
-				rules, err := util.GetRulesForRoleBinding(*roleBinding, saRbacValidatorConfig.RoleInformer, saRbacValidatorConfig.ClusterRoleInformer)
-				if err != nil {
-					return &admissionv1.AdmissionResponse{
-						UID:     request.UID,
-						Allowed: false,
-						Result: &metav1.Status{
-							Message: err.Error(),
-							Code:    http.StatusForbidden,
-						},
-					}
-				}
-				rules = util.ExtendRules(rules)
-				saRules = util.AddRules(saRules, rules)
-			}
-			//TODO: Shortcut if there is no Rolebinding that matches SA in namespace
-			if util.SubjectsMatchesUserOrServiceAccount(roleBinding.Subjects, user, roleBinding.Namespace) {
-				rules, err := util.GetRulesForRoleBinding(*roleBinding, saRbacValidatorConfig.RoleInformer, saRbacValidatorConfig.ClusterRoleInformer)
-				if err != nil {
-					return &admissionv1.AdmissionResponse{
-						UID:     request.UID,
-						Allowed: false,
-						Result: &metav1.Status{
-							Message: err.Error(),
-							Code:    http.StatusForbidden,
-						},
-					}
-				}
-				rules = util.ExtendRules(rules)
-				saRules = util.AddRules(userRules, rules)
-			}
+			endSpan(span, err)
+			logger.Error().Err(err).Msg("Failed to get transitive permissions of ServiceAccount")
+			return report.deny(ReasonInformerError, err.Error())
 		}
-		escalationRules := util.IsRuleEscalation(userRules, saRules)
-		if len(escalationRules) > 0 {
-			isEscalated = true
-			namespacedEscalationRules[namespace.Name] = util.IsRuleEscalation(userRules, saRules)
+		span.SetAttributes(attribute.Int("serviceaccounts.reachable", len(closure.reachable)))
+		span.End()
+		report.ReachableServiceAccounts = closure.reachable
+		if closure.truncated {
+			logger.Warn().Str("ServiceAccountName", serviceAccount).Msg("Transitive analysis truncated")
+			report.Warnings = append(report.Warnings, "Transitive analysis stopped after "+strconv.Itoa(maxTransitiveIdentities)+" ServiceAccounts, the permissions of further reachable ServiceAccounts are not compared.")
 		}
+		saNamespacedRules, saClusterRules = closure.namespaced, closure.cluster
 	}
 
-	var saRules []rbacv1.PolicyRule
-	var userRules []rbacv1.PolicyRule
-	clusterRoleBindings, err := saRbacValidatorConfig.ClusterRoleBindingInformer.Lister().List(labels.Everything())
-	if err != nil {
-		return &admissionv1.AdmissionResponse{
-			UID:     request.UID,
-			Allowed: false,
-			Result: &metav1.Status{
-				Message: err.Error(),
-				Code:    http.StatusForbidden,
-			},
+	phaseStart = time.Now()
+	_, span = tracer.Start(ctx, "NamespacedScan", trace.WithAttributes(RequestUIDAttribute(string(request.UID))))
+	if !followIdentities {
+		saNamespacedRules, err = GetNamespacedPermissions(serviceAccountUser, saRbacValidatorConfig)
+		if err != nil {
+			endSpan(span, err)
+			logger.Error().Err(err).Msg("Failed to get namespaced permissions of ServiceAccount")
+			return report.deny(ReasonInformerError, err.Error())
 		}
 	}
-	for _, clusterRoleBinding := range clusterRoleBindings {
-		if util.SubjectsMatchesUserOrServiceAccount(clusterRoleBinding.Subjects, serviceAccountUser, clusterRoleBinding.Namespace) {
-			rules, err := util.GetRulesForClusterRoleBinding(*clusterRoleBinding, saRbacValidatorConfig.ClusterRoleInformer)
-			if err != nil {
-				return &admissionv1.AdmissionResponse{
-					UID:     request.UID,
-					Allowed: false,
-					Result: &metav1.Status{
-						Message: err.Error(),
-						Code:    403,
-					},
-				}
+	//TODO: Shortcut if there is no Rolebinding that matches SA in namespace
+	userNamespacedRules, err := GetNamespacedPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get namespaced permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	// Rules of ClusterRoleBindings hold in every namespace
+	userClusterRules, err := GetClusterPermissions(user, saRbacValidatorConfig)
+	if err != nil {
+		endSpan(span, err)
+		logger.Error().Err(err).Msg("Failed to get cluster permissions of user")
+		return report.deny(ReasonInformerError, err.Error())
+	}
+	for namespace, saRules := range saNamespacedRules {
+		heldRules := append(append([]rbacv1.PolicyRule{}, userNamespacedRules[namespace]...), userClusterRules...)
+		escalationRules := util.IsRuleEscalation(heldRules, saRules)
+		if len(escalationRules) > 0 {
+			if report.NamespacedEscalations == nil {
+				report.NamespacedEscalations = make(map[string][]rbacv1.PolicyRule)
 			}
-			rules = util.ExtendRules(rules)
-			saRules = util.AddRules(saRules, rules)
+			report.NamespacedEscalations[namespace] = escalationRules
 		}
-		//TODO: Shortcut if there is no Rolebinding that matches SA at cluster scope
-		if util.SubjectsMatchesUserOrServiceAccount(clusterRoleBinding.Subjects, user, clusterRoleBinding.Namespace) {
-			rules, err := util.GetRulesForClusterRoleBinding(*clusterRoleBinding, saRbacValidatorConfig.ClusterRoleInformer)
-			if err != nil {
-				return &admissionv1.AdmissionResponse{
-					UID:     request.UID,
-					Allowed: false,
-					Result: &metav1.Status{
-						Message: err.Error(),
-						Code:    http.StatusForbidden,
-					},
-				}
-			}
-			rules = util.ExtendRules(rules)
-			saRules = util.AddRules(userRules, rules)
+	}
+	observePhase(PhaseNamespacedScan, phaseStart)
+	span.SetAttributes(attribute.Int("namespaces", len(saNamespacedRules)), attribute.Int("namespaces.escalated", len(report.NamespacedEscalations)))
+	span.End()
+
+	phaseStart = time.Now()
+	_, span = tracer.Start(ctx, "ClusterScopeComparison", trace.WithAttributes(RequestUIDAttribute(string(request.UID))))
+	if !followIdentities {
+		saClusterRules, err = GetClusterPermissions(serviceAccountUser, saRbacValidatorConfig)
+		if err != nil {
+			endSpan(span, err)
+			logger.Error().Err(err).Msg("Failed to get cluster permissions of ServiceAccount")
+			return report.deny(ReasonInformerError, err.Error())
 		}
 	}
-	clusterEscalatedRules := util.IsRuleEscalation(userRules, saRules)
-	if isEscalated {
-		var errorString string
-		if len(clusterEscalatedRules) > 0 {
-			rulesString, err := util.RulesToString(clusterEscalatedRules)
-			if err != nil {
-				return &admissionv1.AdmissionResponse{
-					UID:     request.UID,
-					Allowed: false,
-					Result: &metav1.Status{
-						Message: err.Error(),
-						Code:    http.StatusForbidden,
-					},
-				}
+	report.ClusterEscalations = util.IsRuleEscalation(userClusterRules, saClusterRules)
+	observePhase(PhaseClusterScan, phaseStart)
+	span.SetAttributes(attribute.Int("rules.escalated", len(report.ClusterEscalations)))
+	span.End()
+
+	report.ClusterCriticalRules = util.CriticalRules(saClusterRules)
+	for namespace, saRules := range saNamespacedRules {
+		if criticalRules := util.CriticalRules(saRules); len(criticalRules) > 0 {
+			if report.NamespacedCriticalRules == nil {
+				report.NamespacedCriticalRules = make(map[string][]rbacv1.PolicyRule)
 			}
-			errorString = "Request try to grant permissions at Cluster-Scope that are currently not held by user: " + rulesString + "."
+			report.NamespacedCriticalRules[namespace] = criticalRules
 		}
-		if isEscalated {
-			for namespace, rules := range namespacedEscalationRules {
-				rulesString, err := util.RulesToString(rules)
-				if err != nil {
-					return &admissionv1.AdmissionResponse{
-						UID:     request.UID,
-						Allowed: false,
-						Result: &metav1.Status{
-							Message: err.Error(),
-							Code:    http.StatusForbidden,
-						},
-					}
-				}
-				errorString = errorString + "Request try to grant permissions in Namespace: " + namespace + " that are currently not held by user: " + rulesString + "."
-			}
+	}
+	var criticalRulesMessage string
+	if report.HasCriticalRules() {
+		criticalRulesMessage, err = report.criticalRulesMessage()
+		if err != nil {
+			return report.deny(ReasonRuleRenderingError, err.Error())
 		}
+		logger.Warn().Str("ServiceAccountName", serviceAccount).Msg("ServiceAccount holds critical permissions")
+		report.Warnings = append(report.Warnings, criticalRulesMessage)
+	}
 
-		return &admissionv1.AdmissionResponse{
-			UID:     request.UID,
-			Allowed: false,
-			Result: &metav1.Status{
-				Message: errorString,
-				Code:    http.StatusForbidden,
-			},
+	if report.IsEscalation() {
+		message, err := report.escalationMessage()
+		if err != nil {
+			return report.deny(ReasonRuleRenderingError, err.Error())
 		}
+		report.Remediation, err = newRemediation(report, request.Namespace,
+			subjectPermissions{namespaced: saNamespacedRules, cluster: saClusterRules},
+			subjectPermissions{namespaced: userNamespacedRules, cluster: userClusterRules})
+		if err != nil {
+			return report.deny(ReasonRuleRenderingError, err.Error())
+		}
+		message = message + "\n" + report.Remediation.message()
+		logger.Info().Msg("Request denied")
+		return report.deny(ReasonEscalation, message)
 	}
-	return &admissionv1.AdmissionResponse{
-		UID:     request.UID,
-		Allowed: true,
-		Result: &metav1.Status{
-			Message: "Request allowed",
-			Code:    http.StatusOK,
-		},
+	if report.HasCriticalRules() && saRbacValidatorConfig.DenyCriticalPermissions && !saRbacValidatorConfig.CriticalPermissionExemptions.exempts(user) {
+		logger.Info().Msg("Request denied")
+		return report.deny(ReasonCriticalPermission, criticalRulesMessage+" The requester is not exempted from the critical permission policy.")
 	}
-
+	logger.Info().Msg("Request allowed")
+	return report.allow(ReasonAllowed, "Request allowed")
 }
@@ -0,0 +1,916 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "team"
+
+func testRBACObjects() []runtime.Object {
+	podRules := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "create"}}}
+	allRules := []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}}
+	nodeRules := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}}}
+	return append([]runtime.Object{
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "everything"}, Rules: allRules},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pod-creator"}, Rules: podRules},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "everything"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "everything"},
+			Subjects:   []rbacv1.Subject{{Kind: "User", Name: "root"}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-creator"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "pod-creator"},
+			Subjects:   []rbacv1.Subject{{Kind: "User", Name: "carl"}},
+		},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: testNamespace}, Rules: podRules},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: testNamespace}, Rules: allRules},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "nodes"}, Rules: nodeRules},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "pods"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "User", Name: "alice"},
+				{Kind: "ServiceAccount", Name: "builder", Namespace: testNamespace},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "admin"},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "admin", Namespace: testNamespace}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "missing"},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "broken", Namespace: testNamespace}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "nodes"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "nodes"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "Group", Name: "node-readers"},
+				{Kind: "ServiceAccount", Name: "node-reader", Namespace: testNamespace},
+			},
+		},
+	}, testServiceAccounts("builder", "admin", "nodes", "node-reader", "broken", "idle")...)
+}
+
+// testServiceAccounts returns ServiceAccounts with names in the test namespace
+func testServiceAccounts(names ...string) []runtime.Object {
+	var serviceAccounts []runtime.Object
+	for _, name := range names {
+		serviceAccounts = append(serviceAccounts, &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace}})
+	}
+	return serviceAccounts
+}
+
+// newTestClient returns a fake clientset serving objects which answers TokenRequests and TokenReviews
+// for the ServiceAccounts of objects with the groups the apiserver would authenticate them with
+func newTestClient(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		createAction := action.(k8stesting.CreateActionImpl)
+		if createAction.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		// Like the apiserver, TokenRequests fail for ServiceAccounts that do not exist
+		if _, err := client.Tracker().Get(createAction.GetResource(), createAction.GetNamespace(), createAction.Name); err != nil {
+			return true, nil, err
+		}
+		return true, &authenticationv1.TokenRequest{
+			Status: authenticationv1.TokenRequestStatus{Token: createAction.GetNamespace() + "/" + createAction.Name},
+		}, nil
+	})
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		groups := []string{"system:serviceaccounts", "system:serviceaccounts:" + testNamespace, "system:authenticated"}
+		if review.Spec.Token == testNamespace+"/nodes" {
+			groups = append(groups, "node-readers")
+		}
+		return true, &authenticationv1.TokenReview{
+			Status: authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:serviceaccount:" + review.Spec.Token, Groups: groups},
+			},
+		}, nil
+	})
+	return client
+}
+
+func newTestConfig(t *testing.T, client *fake.Clientset) SaRbacValidatorConfig {
+	t.Helper()
+	stopper := make(chan struct{})
+	t.Cleanup(func() { close(stopper) })
+	factory := informers.NewSharedInformerFactory(client, 0)
+	source, err := NewInformerRBACSource(client, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory.Start(stopper)
+	for informerType, synced := range factory.WaitForCacheSync(stopper) {
+		if !synced {
+			t.Fatalf("informer for %s did not sync", informerType)
+		}
+	}
+	return SaRbacValidatorConfig{
+		Logger:                    zerolog.Nop(),
+		Source:                    source,
+		ServiceAccountJsonPointer: "/spec/serviceAccountName",
+		SaNotFoundBehavior:        Deny,
+	}
+}
+
+// newTestAdmissionRequest returns a request of alice creating object, or updating oldObject to object if oldObject is set.
+// Name and namespace of the request are taken from object.
+func newTestAdmissionRequest(t *testing.T, kind schema.GroupVersionKind, object runtime.Object, oldObject runtime.Object) *admissionv1.AdmissionRequest {
+	t.Helper()
+	request := &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      metav1.GroupVersionKind{Group: kind.Group, Version: kind.Version, Kind: kind.Kind},
+		Name:      object.(metav1.Object).GetName(),
+		Namespace: object.(metav1.Object).GetNamespace(),
+		Operation: admissionv1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+	}
+	var err error
+	if request.Object.Raw, err = json.Marshal(object); err != nil {
+		t.Fatal(err)
+	}
+	if oldObject != nil {
+		request.Operation = admissionv1.Update
+		if request.OldObject.Raw, err = json.Marshal(oldObject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return request
+}
+
+// newTestRequest returns a request of username creating a pod running as serviceAccount in testNamespace
+func newTestRequest(t *testing.T, serviceAccount string, username string, groups ...string) *admissionv1.AdmissionRequest {
+	t.Helper()
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: testNamespace},
+		Spec:       corev1.PodSpec{ServiceAccountName: serviceAccount},
+	}
+	request := newTestAdmissionRequest(t, corev1.SchemeGroupVersion.WithKind("Pod"), pod, nil)
+	request.UserInfo = authenticationv1.UserInfo{Username: username, Groups: append(groups, "system:authenticated")}
+	return request
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name               string
+		request            *admissionv1.AdmissionRequest
+		saNotFoundBehavior int
+		transitive         bool
+		allowed            bool
+		reason             string
+		clusterEscalations bool
+		escalatedNamespace string
+	}{
+		{
+			name:    "service account with permissions held by the requester is allowed",
+			request: newTestRequest(t, "builder", "alice"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+		{
+			name:               "service account with namespaced permissions not held by the requester is denied",
+			request:            newTestRequest(t, "admin", "alice"),
+			reason:             ReasonEscalation,
+			escalatedNamespace: testNamespace,
+		},
+		{
+			name:               "service account with cluster permissions not held by the requester is denied",
+			request:            newTestRequest(t, "nodes", "alice"),
+			reason:             ReasonEscalation,
+			clusterEscalations: true,
+		},
+		{
+			name:    "service account with cluster permissions held through a group of the requester is allowed",
+			request: newTestRequest(t, "nodes", "alice", "node-readers"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+		{
+			name:               "service account bound by a ClusterRoleBinding is denied",
+			request:            newTestRequest(t, "node-reader", "alice"),
+			reason:             ReasonEscalation,
+			clusterEscalations: true,
+		},
+		{
+			name:    "service account with permissions held by the requesting service account is allowed",
+			request: newTestRequest(t, "nodes", "system:serviceaccount:"+testNamespace+":node-reader"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+		{
+			name:    "service account with namespaced permissions held by the requester through a ClusterRoleBinding is allowed",
+			request: newTestRequest(t, "admin", "root"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+		{
+			name:       "service account reaching other service accounts is allowed for a requester holding all permissions cluster-wide",
+			request:    newTestRequest(t, "builder", "root"),
+			transitive: true,
+			allowed:    true,
+			reason:     ReasonAllowed,
+		},
+		{
+			name:               "service account reaching other service accounts is denied for a requester holding only cluster-wide pod permissions",
+			request:            newTestRequest(t, "builder", "carl"),
+			transitive:         true,
+			reason:             ReasonEscalation,
+			clusterEscalations: true,
+			escalatedNamespace: testNamespace,
+		},
+		{
+			name:    "service account without any permissions is allowed",
+			request: newTestRequest(t, "idle", "bob"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+		{
+			name:    "service account that does not exist is denied",
+			request: newTestRequest(t, "nobody", "bob"),
+			reason:  ReasonIdentityError,
+		},
+		{
+			name:               "missing service account is denied with behavior deny",
+			request:            newTestRequest(t, "", "alice"),
+			saNotFoundBehavior: Deny,
+			reason:             ReasonSaNotFound,
+		},
+		{
+			name:               "missing service account is allowed with behavior allow",
+			request:            newTestRequest(t, "", "alice"),
+			saNotFoundBehavior: Allow,
+			allowed:            true,
+			reason:             ReasonSaNotFound,
+		},
+		{
+			name:    "binding to a missing role grants nothing",
+			request: newTestRequest(t, "broken", "alice"),
+			allowed: true,
+			reason:  ReasonAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestConfig(t, newTestClient(testRBACObjects()...))
+			config.SaNotFoundBehavior = test.saNotFoundBehavior
+			config.TransitiveAnalysis = test.transitive
+
+			report := Evaluate(context.Background(), test.request, config)
+			if report.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t: %s", test.allowed, report.Allowed, report.Message)
+			}
+			if report.Reason != test.reason {
+				t.Errorf("expected reason %q, got %q", test.reason, report.Reason)
+			}
+			if (len(report.ClusterEscalations) > 0) != test.clusterEscalations {
+				t.Errorf("expected cluster escalations %t, got %v", test.clusterEscalations, report.ClusterEscalations)
+			}
+			if test.escalatedNamespace != "" && len(report.NamespacedEscalations[test.escalatedNamespace]) == 0 {
+				t.Errorf("expected escalations in namespace %s, got %v", test.escalatedNamespace, report.NamespacedEscalations)
+			}
+			if (report.Reason == ReasonEscalation) != (report.Remediation != nil) {
+				t.Errorf("expected a remediation only for escalations, got %v", report.Remediation)
+			}
+			if test.escalatedNamespace == "" && len(report.NamespacedEscalations) > 0 {
+				t.Errorf("expected no namespaced escalations, got %v", report.NamespacedEscalations)
+			}
+
+			response := Validate(context.Background(), test.request, config)
+			if response.UID != test.request.UID {
+				t.Errorf("expected response UID %s, got %s", test.request.UID, response.UID)
+			}
+			if response.Allowed != test.allowed {
+				t.Errorf("expected response allowed %t, got %t", test.allowed, response.Allowed)
+			}
+			expectedCode := int32(http.StatusForbidden)
+			if test.allowed {
+				expectedCode = http.StatusOK
+			}
+			if response.Result.Code != expectedCode {
+				t.Errorf("expected response code %d, got %d", expectedCode, response.Result.Code)
+			}
+		})
+	}
+}
+
+func TestValidateApiErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		call     string
+	}{
+		{name: "failed TokenRequest is denied", resource: "serviceaccounts", call: "TokenRequest"},
+		{name: "failed TokenReview is denied", resource: "tokenreviews", call: "TokenReview"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(testRBACObjects()...)
+			client.PrependReactor("create", test.resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("unavailable")
+			})
+			config := newTestConfig(t, client)
+
+			report := Evaluate(context.Background(), newTestRequest(t, "builder", "alice"), config)
+			if report.Allowed {
+				t.Fatal("expected request to be denied")
+			}
+			if report.Reason != ReasonIdentityError {
+				t.Errorf("expected reason %q, got %q", ReasonIdentityError, report.Reason)
+			}
+			if report.Message != test.call+" failed: unavailable" {
+				t.Errorf("unexpected message %q", report.Message)
+			}
+		})
+	}
+}
+
+func TestValidateMemorySourceMatchesInformerSource(t *testing.T) {
+	informerConfig := newTestConfig(t, newTestClient(testRBACObjects()...))
+	memoryConfig := informerConfig
+	memoryConfig.Source = NewMemoryRBACSource(testRBACObjects()...)
+
+	// The memory source resolves ServiceAccounts without TokenReviews, so the group bound in the nodes ClusterRoleBinding is not tested
+	for _, serviceAccount := range []string{"builder", "admin", "node-reader", "idle"} {
+		request := newTestRequest(t, serviceAccount, "alice")
+		informerReport := Evaluate(context.Background(), request, informerConfig)
+		memoryReport := Evaluate(context.Background(), request, memoryConfig)
+		if informerReport.Allowed != memoryReport.Allowed || informerReport.Message != memoryReport.Message {
+			t.Errorf("%s: informer source returned %t %q, memory source returned %t %q", serviceAccount,
+				informerReport.Allowed, informerReport.Message, memoryReport.Allowed, memoryReport.Message)
+		}
+	}
+}
+
+func TestRemediation(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods-and-secrets", Namespace: testNamespace},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "delete"}},
+				{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods-and-secrets", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "pods-and-secrets"},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "partial", Namespace: testNamespace}},
+		},
+	)
+	objects = append(objects, testServiceAccounts("partial")...)
+	config := newTestConfig(t, newTestClient(objects...))
+
+	report := Evaluate(context.Background(), newTestRequest(t, "partial", "alice"), config)
+	if report.Remediation == nil {
+		t.Fatalf("expected a remediation, got report %+v", report)
+	}
+	requesterGrant := `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: sa-rbac-validator-alice
+  namespace: team
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - pods
+  verbs:
+  - delete
+- apiGroups:
+  - ""
+  resources:
+  - secrets
+  verbs:
+  - get
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: sa-rbac-validator-alice
+  namespace: team
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: sa-rbac-validator-alice
+subjects:
+- apiGroup: rbac.authorization.k8s.io
+  kind: User
+  name: alice
+`
+	if report.Remediation.RequesterGrant != requesterGrant {
+		t.Errorf("unexpected requester grant:\n%s", report.Remediation.RequesterGrant)
+	}
+	serviceAccountReduction := `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: partial-reduced
+  namespace: team
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - pods
+  verbs:
+  - get
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: partial-reduced
+  namespace: team
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: partial-reduced
+subjects:
+- kind: ServiceAccount
+  name: partial
+  namespace: team
+`
+	if report.Remediation.ServiceAccountReduction != serviceAccountReduction {
+		t.Errorf("unexpected ServiceAccount reduction:\n%s", report.Remediation.ServiceAccountReduction)
+	}
+}
+
+func TestCriticalPermissions(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "impersonator", Namespace: testNamespace},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"serviceaccounts"}, ResourceNames: []string{"deployer"}, Verbs: []string{"impersonate"}},
+				{APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"userextras/scopes"}, Verbs: []string{"impersonate"}},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "impersonator", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "impersonator"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "ServiceAccount", Name: "impersonator", Namespace: testNamespace},
+				{Kind: "Group", Name: "impersonators"},
+			},
+		},
+	)
+	objects = append(objects, testServiceAccounts("impersonator")...)
+	tests := []struct {
+		name       string
+		deny       bool
+		exemptions CriticalPermissionExemptions
+		groups     []string
+		allowed    bool
+		reason     string
+	}{
+		{name: "critical permissions not held by the requester are an escalation", reason: ReasonEscalation},
+		{name: "critical permissions held by the requester are allowed with a warning", groups: []string{"impersonators"}, allowed: true, reason: ReasonAllowed},
+		{name: "critical permissions are denied by policy", deny: true, groups: []string{"impersonators"}, reason: ReasonCriticalPermission},
+		{name: "exempted requesters holding the critical permissions are allowed", deny: true, exemptions: CriticalPermissionExemptions{Groups: []string{"impersonators"}}, groups: []string{"impersonators"}, allowed: true, reason: ReasonAllowed},
+		{name: "exempted requesters not holding the critical permissions are denied", deny: true, exemptions: CriticalPermissionExemptions{Users: []string{"alice"}}, reason: ReasonEscalation},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestConfig(t, newTestClient(objects...))
+			config.DenyCriticalPermissions = test.deny
+			config.CriticalPermissionExemptions = test.exemptions
+
+			report := Evaluate(context.Background(), newTestRequest(t, "impersonator", "alice", test.groups...), config)
+			if report.Allowed != test.allowed || report.Reason != test.reason {
+				t.Errorf("expected allowed %t with reason %q, got %t with %q: %s", test.allowed, test.reason, report.Allowed, report.Reason, report.Message)
+			}
+			expected := []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"serviceaccounts"}, ResourceNames: []string{"deployer"}, Verbs: []string{"impersonate"}},
+				{APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"userextras/scopes"}, Verbs: []string{"impersonate"}},
+			}
+			if !reflect.DeepEqual(report.NamespacedCriticalRules[testNamespace], expected) {
+				t.Errorf("expected critical rules %v, got %v", expected, report.NamespacedCriticalRules)
+			}
+			if len(report.Warnings) != 1 {
+				t.Errorf("expected a warning, got %v", report.Warnings)
+			}
+		})
+	}
+}
+
+func TestTransitiveAnalysis(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "token-minter", Namespace: testNamespace},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"serviceaccounts/token"}, ResourceNames: []string{"node-reader"}, Verbs: []string{"create"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "token-minter", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "token-minter"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "ServiceAccount", Name: "token-minter", Namespace: testNamespace},
+				{Kind: "User", Name: "alice"},
+			},
+		},
+	)
+	objects = append(objects, testServiceAccounts("token-minter")...)
+	tests := []struct {
+		name           string
+		serviceAccount string
+		transitive     bool
+		allowed        bool
+		reachable      []string
+	}{
+		{name: "pod creation is not followed without transitive analysis", serviceAccount: "builder", allowed: true},
+		{name: "pod creation reaches all service accounts of the namespace", serviceAccount: "builder", transitive: true, reachable: []string{"team/*", "team/admin", "team/broken", "team/node-reader", "team/token-minter"}},
+		{name: "token creation reaches the named service account", serviceAccount: "token-minter", transitive: true, reachable: []string{"team/node-reader"}},
+		{name: "service account without transitive permissions reaches nothing", serviceAccount: "node-reader", transitive: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestConfig(t, newTestClient(objects...))
+			config.TransitiveAnalysis = test.transitive
+
+			report := Evaluate(context.Background(), newTestRequest(t, test.serviceAccount, "alice"), config)
+			if report.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t with reason %q: %s", test.allowed, report.Allowed, report.Reason, report.Message)
+			}
+			if !reflect.DeepEqual(report.ReachableServiceAccounts, test.reachable) {
+				t.Errorf("expected reachable service accounts %v, got %v", test.reachable, report.ReachableServiceAccounts)
+			}
+		})
+	}
+}
+
+func TestLegacyTokenAnalysis(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin-token", Namespace: testNamespace, Annotations: map[string]string{corev1.ServiceAccountNameKey: "admin"}},
+			Type:       corev1.SecretTypeServiceAccountToken,
+			Data:       map[string][]byte{"token": []byte("secret")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: testNamespace, Annotations: map[string]string{corev1.ServiceAccountNameKey: "admin"}},
+			Type:       corev1.SecretTypeOpaque,
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-reader", Namespace: testNamespace},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"admin-token"}, Verbs: []string{"get"}},
+				{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"config"}, Verbs: []string{"list"}},
+			},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-reader", Namespace: testNamespace},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"config"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-reader", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "secret-reader"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "ServiceAccount", Name: "secret-reader", Namespace: testNamespace},
+				{Kind: "User", Name: "alice"},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-reader", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "config-reader"},
+			Subjects: []rbacv1.Subject{
+				{Kind: "ServiceAccount", Name: "config-reader", Namespace: testNamespace},
+				{Kind: "User", Name: "alice"},
+			},
+		},
+	)
+	objects = append(objects, testServiceAccounts("secret-reader", "config-reader")...)
+	tests := []struct {
+		name           string
+		serviceAccount string
+		legacyToken    bool
+		allowed        bool
+		reachable      []string
+	}{
+		{name: "token secret reads are not followed without legacy token analysis", serviceAccount: "secret-reader", allowed: true},
+		{name: "reading a token secret reaches its service account", serviceAccount: "secret-reader", legacyToken: true, reachable: []string{"team/admin"}},
+		{name: "reading other secrets reaches nothing", serviceAccount: "config-reader", legacyToken: true, allowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SaRbacValidatorConfig{
+				Logger:                    zerolog.Nop(),
+				Source:                    NewMemoryRBACSource(objects...),
+				ServiceAccountJsonPointer: "/spec/serviceAccountName",
+				SaNotFoundBehavior:        Deny,
+				LegacyTokenAnalysis:       test.legacyToken,
+			}
+
+			report := Evaluate(context.Background(), newTestRequest(t, test.serviceAccount, "alice"), config)
+			if report.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t with reason %q: %s", test.allowed, report.Allowed, report.Reason, report.Message)
+			}
+			if !reflect.DeepEqual(report.ReachableServiceAccounts, test.reachable) {
+				t.Errorf("expected reachable service accounts %v, got %v", test.reachable, report.ReachableServiceAccounts)
+			}
+		})
+	}
+}
+
+func TestPodTokens(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin-token", Namespace: testNamespace, Annotations: map[string]string{corev1.ServiceAccountNameKey: "admin"}},
+			Type:       corev1.SecretTypeServiceAccountToken,
+		},
+	)
+	disabled := false
+	tests := []struct {
+		name           string
+		serviceAccount string
+		spec           corev1.PodSpec
+		legacyToken    bool
+		allowed        bool
+		tokens         []string
+	}{
+		{
+			name: "service account without automounted token is allowed", serviceAccount: "admin",
+			spec: corev1.PodSpec{AutomountServiceAccountToken: &disabled}, allowed: true,
+		},
+		{
+			name: "projected token of the service account is compared", serviceAccount: "admin",
+			spec: corev1.PodSpec{
+				AutomountServiceAccountToken: &disabled,
+				Volumes: []corev1.Volume{{Name: "token", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{Path: "token"}}},
+				}}}},
+			},
+		},
+		{
+			name: "mounted token secrets are not inspected without legacy token analysis", serviceAccount: "builder",
+			spec:    corev1.PodSpec{Volumes: []corev1.Volume{{Name: "token", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "admin-token"}}}}},
+			allowed: true,
+		},
+		{
+			name: "mounted token secret adds its service account", serviceAccount: "builder", legacyToken: true,
+			spec:   corev1.PodSpec{Volumes: []corev1.Volume{{Name: "token", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "admin-token"}}}}},
+			tokens: []string{"team/admin"},
+		},
+		{
+			name: "token secret in the environment adds its service account", serviceAccount: "builder", legacyToken: true,
+			spec: corev1.PodSpec{
+				AutomountServiceAccountToken: &disabled,
+				Containers: []corev1.Container{{Name: "main", Env: []corev1.EnvVar{{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "admin-token"}, Key: "token"},
+				}}}}},
+			},
+			tokens: []string{"team/admin"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := SaRbacValidatorConfig{
+				Logger:                    zerolog.Nop(),
+				Source:                    NewMemoryRBACSource(objects...),
+				ServiceAccountJsonPointer: "/spec/serviceAccountName",
+				SaNotFoundBehavior:        Deny,
+				LegacyTokenAnalysis:       test.legacyToken,
+			}
+			test.spec.ServiceAccountName = test.serviceAccount
+			pod := corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: testNamespace},
+				Spec:       test.spec,
+			}
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := newTestRequest(t, test.serviceAccount, "alice")
+			request.Object.Raw = raw
+
+			report := Evaluate(context.Background(), request, config)
+			if report.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t with reason %q: %s", test.allowed, report.Allowed, report.Reason, report.Message)
+			}
+			if !reflect.DeepEqual(report.TokenServiceAccounts, test.tokens) {
+				t.Errorf("expected token service accounts %v, got %v", test.tokens, report.TokenServiceAccounts)
+			}
+		})
+	}
+}
+
+func TestRequesterClusterRulesHoldInNamespaces(t *testing.T) {
+	objects := append(testRBACObjects(),
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-admin"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-admin"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"},
+			Subjects:   []rbacv1.Subject{{Kind: "User", Name: "root"}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "pod-reader"},
+			Subjects:   []rbacv1.Subject{{Kind: "User", Name: "carol"}},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods-and-secrets", Namespace: testNamespace},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+				{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods-and-secrets", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "pods-and-secrets"},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "partial", Namespace: testNamespace}},
+		},
+	)
+	config := SaRbacValidatorConfig{
+		Logger:                    zerolog.Nop(),
+		Source:                    NewMemoryRBACSource(objects...),
+		ServiceAccountJsonPointer: "/spec/serviceAccountName",
+		SaNotFoundBehavior:        Deny,
+	}
+
+	for _, serviceAccount := range []string{"builder", "admin", "partial"} {
+		report := Evaluate(context.Background(), newTestRequest(t, serviceAccount, "root"), config)
+		if !report.Allowed {
+			t.Errorf("%s: expected cluster-admin to be allowed, got reason %q: %s", serviceAccount, report.Reason, report.Message)
+		}
+	}
+
+	report := Evaluate(context.Background(), newTestRequest(t, "partial", "carol"), config)
+	if report.Allowed {
+		t.Fatal("expected request to be denied")
+	}
+	expected := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}}
+	if !reflect.DeepEqual(report.NamespacedEscalations[testNamespace], expected) {
+		t.Errorf("expected escalations %v, got %v", expected, report.NamespacedEscalations)
+	}
+	serviceAccountReduction := `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: partial-reduced
+  namespace: team
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - pods
+  verbs:
+  - get
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: partial-reduced
+  namespace: team
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: partial-reduced
+subjects:
+- kind: ServiceAccount
+  name: partial
+  namespace: team
+`
+	if report.Remediation == nil || report.Remediation.ServiceAccountReduction != serviceAccountReduction {
+		t.Errorf("unexpected remediation %+v", report.Remediation)
+	}
+}
+
+func TestPodTokensOfCustomResources(t *testing.T) {
+	config := SaRbacValidatorConfig{
+		Logger:                    zerolog.Nop(),
+		Source:                    NewMemoryRBACSource(testRBACObjects()...),
+		ServiceAccountJsonPointer: "/spec/serviceAccountName",
+		SaNotFoundBehavior:        Deny,
+	}
+	// Fields named like PodSpec fields are not inspected for kinds without a PodSpec
+	request := newTestRequest(t, "admin", "alice")
+	request.Kind = metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Workload"}
+	request.Object.Raw = []byte(`{"apiVersion":"example.com/v1","kind":"Workload","metadata":{"name":"test"},"spec":{"serviceAccountName":"admin","automountServiceAccountToken":false,"volumes":"none"}}`)
+
+	report := Evaluate(context.Background(), request, config)
+	if report.Allowed || report.Reason != ReasonEscalation {
+		t.Errorf("expected an escalation, got allowed %t with reason %q: %s", report.Allowed, report.Reason, report.Message)
+	}
+}
+
+// comparisonManifests bind the ServiceAccount reader and alice to a Role in team
+// and the ServiceAccounts of ops and carl to a ClusterRole
+var comparisonManifests = [][]byte{
+	[]byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pod-reader
+  namespace: team
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get", "list"]
+`),
+	[]byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: pod-reader
+  namespace: team
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: pod-reader
+subjects:
+- kind: ServiceAccount
+  name: reader
+  namespace: team
+- kind: User
+  apiGroup: rbac.authorization.k8s.io
+  name: alice
+`),
+	[]byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: node-reader
+rules:
+- apiGroups: [""]
+  resources: ["nodes"]
+  verbs: ["get"]
+`),
+	[]byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: node-reader
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: node-reader
+subjects:
+- kind: Group
+  apiGroup: rbac.authorization.k8s.io
+  name: system:serviceaccounts:ops
+- kind: User
+  apiGroup: rbac.authorization.k8s.io
+  name: carl
+`),
+}
+
+// TestRequesterRulesComparison checks that the rules of the requester are compared with the rules of the
+// ServiceAccount in every namespace and at cluster scope
+func TestRequesterRulesComparison(t *testing.T) {
+	config := SaRbacValidatorConfig{
+		Logger:                    zerolog.Nop(),
+		Source:                    NewStaticRBACSource(comparisonManifests, "team", zerolog.Nop()),
+		ServiceAccountJsonPointer: "/spec/serviceAccountName",
+	}
+
+	tests := []struct {
+		name           string
+		namespace      string
+		serviceAccount string
+		username       string
+		allowed        bool
+	}{
+		{name: "requester holding the namespaced rules", namespace: "team", serviceAccount: "reader", username: "alice", allowed: true},
+		{name: "requester missing the namespaced rules", namespace: "team", serviceAccount: "reader", username: "bob", allowed: false},
+		{name: "requester holding the cluster rules", namespace: "ops", serviceAccount: "builder", username: "carl", allowed: true},
+		{name: "requester missing the cluster rules", namespace: "ops", serviceAccount: "builder", username: "bob", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"},"spec":{"serviceAccountName":"` + test.serviceAccount + `"}}`)
+			request, err := NewAdmissionRequest(pod, authenticationv1.UserInfo{Username: test.username, Groups: []string{"system:authenticated"}}, test.namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := Validate(context.Background(), request, config)
+			if response.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t: %s", test.allowed, response.Allowed, response.Result.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+const (
+	defaultMaxRequestBytes = 8 << 20
+	shutdownTimeout        = 25 * time.Second
+)
+
+// validateFunc decides about an AdmissionRequest, e.g. pkg.Validate or pkg.ValidateBinding
+type validateFunc func(context.Context, *admissionv1.AdmissionRequest, pkg.SaRbacValidatorConfig) *admissionv1.AdmissionResponse
+
+type validatingWebhook struct {
+	validate              validateFunc
+	saRbacValidatorConfig pkg.SaRbacValidatorConfig
+	configLoader          *pkg.ConfigLoader
+	maxRequestBytes       int64
+}
+
+// ServeHTTP answers AdmissionReviews of admission.k8s.io/v1 and v1beta1 in the apiVersion of the request
+func (v *validatingWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	r.Body = http.MaxBytesReader(w, r.Body, v.maxRequestBytes)
+	body, err := io.ReadAll(r.Body)
+	apiVersion := pkg.AdmissionReviewV1
+	var request *admissionv1.AdmissionRequest
+	if err == nil {
+		request, apiVersion, err = pkg.DecodeAdmissionReview(body)
+	}
+	if err != nil {
+		v.saRbacValidatorConfig.Logger.Error().Err(err).Msg("Failed to decode incoming AdmissionReview")
+		responseBytes, err := pkg.EncodeAdmissionReview(apiVersion, &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			},
+		})
+		if err != nil {
+			v.saRbacValidatorConfig.Logger.Error().Err(err).Msg("Failed to Marshall ErrorResponse")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseBytes)
+		return
+	}
+
+	ctx, span := pkg.Tracer().Start(ctx, "ServeHTTP", trace.WithAttributes(pkg.RequestUIDAttribute(string(request.UID)), attribute.String("admission.review.version", apiVersion)))
+	defer span.End()
+	response := v.validate(ctx, request, v.configLoader.Current().Apply(v.saRbacValidatorConfig))
+	span.SetAttributes(attribute.Bool("admission.response.allowed", response.Allowed))
+
+	responseBytes, err := pkg.EncodeAdmissionReview(apiVersion, response)
+	if err != nil {
+		v.saRbacValidatorConfig.Logger.Error().Err(err).Msg("Failed to Marshall Response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+func runServe(args []string) int {
+	flags := newFlagSet("serve", "", "Serve the validating webhook. This is the default command if none is given.")
+	configFlags := registerConfigFlags(flags)
+	configReloadInterval := durationFlag(flags, "config-reload-interval", "SA_RBAC_VALIDATOR_CONFIG_RELOAD_INTERVAL", 10*time.Second, "Interval in which the config file is checked for changes")
+	kubeconfig := stringFlag(flags, "kubeconfig", "SA_RBAC_VALIDATOR_KUBECONFIG", "", "Path to a kubeconfig file. The in-cluster config is used if neither kubeconfig nor context are set")
+	kubeContext := stringFlag(flags, "context", "SA_RBAC_VALIDATOR_KUBE_CONTEXT", "", "Context of the kubeconfig to use")
+	insecureHTTP := boolFlag(flags, "insecure-http", "SA_RBAC_VALIDATOR_INSECURE_HTTP", false, "Serve plain http without tls, only for development")
+	listenAddress := stringFlag(flags, "listen-address", "SA_RBAC_VALIDATOR_LISTEN_ADDRESS", "", "Address the http listener binds to, all interfaces if empty")
+	port := stringFlag(flags, "port", "SA_RBAC_VALIDATOR_PORT", "8443", "Port of the http listener")
+	maxRequestBytes := int64Flag(flags, "max-request-bytes", "SA_RBAC_VALIDATOR_MAX_REQUEST_BYTES", defaultMaxRequestBytes, "Maximum size of an AdmissionReview request body")
+	otlpEndpoint := stringFlag(flags, "otlp-endpoint", "SA_RBAC_VALIDATOR_OTLP_ENDPOINT", "", "host:port of an OTLP/HTTP collector, tracing is disabled if empty")
+	otlpInsecure := boolFlag(flags, "otlp-insecure", "SA_RBAC_VALIDATOR_OTLP_INSECURE", false, "Use plain http to connect to the OTLP collector")
+	certFile := stringFlag(flags, "tls-cert-file", "SA_RBAC_VALIDATOR_TLS_CERT_FILE", "/var/run/secrets/certs/tls.crt", "Path to the serving certificate")
+	keyFile := stringFlag(flags, "tls-key-file", "SA_RBAC_VALIDATOR_TLS_KEY_FILE", "/var/run/secrets/certs/tls.key", "Path to the key of the serving certificate")
+	certReloadInterval := durationFlag(flags, "cert-reload-interval", "SA_RBAC_VALIDATOR_CERT_RELOAD_INTERVAL", 30*time.Second, "Interval in which the certificate files are checked for changes")
+	certExpiryWarning := durationFlag(flags, "cert-expiry-warning", "SA_RBAC_VALIDATOR_CERT_EXPIRY_WARNING", 7*24*time.Hour, "Log a warning if the certificate expires within this period")
+	certBootstrap := boolFlag(flags, "cert-bootstrap", "SA_RBAC_VALIDATOR_CERT_BOOTSTRAP", false, "Generate the certificates, store them in a Secret and inject the caBundle into the webhook configuration")
+	namespace := stringFlag(flags, "namespace", "SA_RBAC_VALIDATOR_NAMESPACE", "", "Namespace of the certificate Secret and the Service")
+	certSecretName := stringFlag(flags, "cert-secret-name", "SA_RBAC_VALIDATOR_CERT_SECRET_NAME", "", "Name of the Secret that stores the bootstrapped certificates")
+	serviceName := stringFlag(flags, "service-name", "SA_RBAC_VALIDATOR_SERVICE_NAME", "", "Name of the Service the bootstrapped certificate is issued for")
+	webhookConfigName := stringFlag(flags, "webhook-config-name", "SA_RBAC_VALIDATOR_WEBHOOK_CONFIG_NAME", "", "Name of the ValidatingWebhookConfiguration whose caBundle is injected")
+	certRenewBefore := durationFlag(flags, "cert-renew-before", "SA_RBAC_VALIDATOR_CERT_RENEW_BEFORE", 30*24*time.Hour, "Renew bootstrapped certificates this long before they expire")
+	permissionCacheSize := int64Flag(flags, "permission-cache-size", "SA_RBAC_VALIDATOR_PERMISSION_CACHE_SIZE", 1000, "Maximum number of cached effective permissions, the cache is disabled with 0")
+	legacyTokenAnalysis := boolFlag(flags, "legacy-token-analysis", "SA_RBAC_VALIDATOR_LEGACY_TOKEN_ANALYSIS", false, "Watch the metadata of legacy ServiceAccount token Secrets and add the permissions of the ServiceAccounts whose tokens the ServiceAccount can read")
+	watchPods := boolFlag(flags, "watch-pods", "SA_RBAC_VALIDATOR_WATCH_PODS", false, "Watch the ServiceAccounts of pods to list the pods affected by Role and ClusterRole changes and to resolve exec and attach targets from the cache")
+	certCheckInterval := durationFlag(flags, "cert-check-interval", "SA_RBAC_VALIDATOR_CERT_CHECK_INTERVAL", time.Hour, "Interval in which the bootstrapped certificates are checked")
+	flags.Parse(args)
+
+	logger := zerolog.New(os.Stderr).With().Timestamp().Caller().Logger()
+
+	configLoader, err := pkg.NewConfigLoader(*configFlags.configFile, *configReloadInterval, configFlags.overrides(), logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load config")
+	}
+	logger = logger.Level(configLoader.Current().LogLevel)
+
+	if *otlpEndpoint != "" {
+		logger.Info().Str("Endpoint", *otlpEndpoint).Msg("Setup OpenTelemetry tracing")
+		shutdownTracing, err := pkg.SetupTracing(context.Background(), *otlpEndpoint, *otlpInsecure, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to setup OpenTelemetry tracing")
+		}
+		defer shutdownTracing(context.Background())
+	}
+
+	logger.Info().Str("Kubeconfig", *kubeconfig).Str("Context", *kubeContext).Msg("Reading Cluster Config")
+	config, err := pkg.LoadClientConfig(*kubeconfig, *kubeContext)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error getting kubernetes client config")
+	}
+	logger.Info().Msg("Creating kubernetes client")
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error creating kubernetes client")
+	}
+
+	if *maxRequestBytes <= 0 {
+		logger.Fatal().Int64("MaxRequestBytes", *maxRequestBytes).Msg("max-request-bytes must be positive")
+	}
+
+	// In bootstrap mode the certificate is generated by the leader and read from the Secret instead of files
+	var certificateProvider *pkg.CertificateProvider
+	if *insecureHTTP {
+		if *certBootstrap {
+			logger.Fatal().Msg("Certificate bootstrap can not be combined with insecure http")
+		}
+		logger.Warn().Msg("Serving plain http without tls, the apiserver only accepts this for webhooks configured with an url")
+	} else {
+		if *certBootstrap {
+			for _, flag := range []struct{ name, value string }{
+				{"namespace", *namespace},
+				{"cert-secret-name", *certSecretName},
+				{"service-name", *serviceName},
+				{"webhook-config-name", *webhookConfigName},
+			} {
+				if flag.value == "" {
+					logger.Fatal().Str("Flag", flag.name).Msg("Certificate bootstrap requires the flag to be set")
+				}
+			}
+			*certFile = ""
+			*keyFile = ""
+		}
+		logger.Info().Str("CertFile", *certFile).Str("KeyFile", *keyFile).Bool("CertBootstrap", *certBootstrap).Msg("Loading certificate")
+		certificateProvider, err = pkg.NewCertificateProvider(*certFile, *keyFile, *certReloadInterval, *certExpiryWarning, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load certificate")
+		}
+	}
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+	stopper := make(chan struct{})
+
+	logger.Info().Msg("Creating Informers")
+	factory := informers.NewSharedInformerFactory(client, 0)
+	rbacSource, err := pkg.NewInformerRBACSource(client, factory)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to index bindings")
+	}
+
+	var permissionCache *pkg.PermissionCache
+	if *permissionCacheSize > 0 {
+		logger.Info().Int64("Size", *permissionCacheSize).Msg("Creating permission cache")
+		permissionCache = pkg.NewPermissionCache(int(*permissionCacheSize))
+		if err := permissionCache.Watch(rbacSource); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to watch RBAC changes for the permission cache")
+		}
+	}
+
+	if *watchPods {
+		logger.Info().Msg("Creating pod informer")
+		if err := rbacSource.WatchPods(factory); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to index pods")
+		}
+	}
+
+	var tokenSecretFactory *pkg.TokenSecretInformerFactory
+	if *legacyTokenAnalysis {
+		logger.Info().Msg("Creating token Secret informer")
+		metadataClient, err := metadata.NewForConfig(config)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error creating kubernetes metadata client")
+		}
+		tokenSecretFactory = pkg.NewTokenSecretInformerFactory(metadataClient)
+		rbacSource.WatchTokenSecrets(tokenSecretFactory)
+	}
+
+	logger.Info().Msg("Start Informers")
+	factory.Start(stopper)
+	if tokenSecretFactory != nil {
+		tokenSecretFactory.Start(stopper)
+	}
+
+	logger.Info().Msg("Start config watcher")
+	go configLoader.Run(stopper)
+
+	if certificateProvider != nil {
+		logger.Info().Msg("Start certificate watcher")
+		go certificateProvider.Run(stopper)
+	}
+
+	if *certBootstrap {
+		hostname, _ := os.Hostname()
+		certBootstrapper := &pkg.CertBootstrapper{
+			Client:              client,
+			Logger:              logger,
+			Namespace:           *namespace,
+			SecretName:          *certSecretName,
+			ServiceName:         *serviceName,
+			WebhookConfigName:   *webhookConfigName,
+			Identity:            hostname,
+			RenewBefore:         *certRenewBefore,
+			CheckInterval:       *certCheckInterval,
+			CertificateProvider: certificateProvider,
+		}
+		logger.Info().Msg("Start certificate bootstrapper")
+		go certBootstrapper.Run(signalCtx)
+	}
+
+	mux := http.NewServeMux()
+
+	logger.Info().Msg("Add health endpoints")
+	mux.HandleFunc("/healthz", pkg.Healthz)
+	mux.Handle("/readyz", &pkg.ReadinessChecker{
+		InformersSynced:     rbacSource.InformersSynced(),
+		ConfigLoader:        configLoader,
+		CertificateProvider: certificateProvider,
+	})
+
+	saRbacValidatorConfig := pkg.SaRbacValidatorConfig{
+		Logger:              logger,
+		Source:              rbacSource,
+		PermissionCache:     permissionCache,
+		LegacyTokenAnalysis: *legacyTokenAnalysis,
+	}
+
+	logger.Info().Msg("Add metrics endpoint")
+	pkg.RegisterInformerMetrics(rbacSource)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Info().Msg("Add validate endpoint")
+	mux.Handle("/validate", &validatingWebhook{
+		validate:              pkg.Validate,
+		saRbacValidatorConfig: saRbacValidatorConfig,
+		configLoader:          configLoader,
+		maxRequestBytes:       *maxRequestBytes,
+	})
+
+	logger.Info().Msg("Add validate-roles endpoint")
+	mux.Handle("/validate-roles", &validatingWebhook{
+		validate:              pkg.ValidateRoleUpdate,
+		saRbacValidatorConfig: saRbacValidatorConfig,
+		configLoader:          configLoader,
+		maxRequestBytes:       *maxRequestBytes,
+	})
+
+	logger.Info().Msg("Add validate-pod-access endpoint")
+	mux.Handle("/validate-pod-access", &validatingWebhook{
+		validate:              pkg.ValidatePodAccess,
+		saRbacValidatorConfig: saRbacValidatorConfig,
+		configLoader:          configLoader,
+		maxRequestBytes:       *maxRequestBytes,
+	})
+
+	logger.Info().Msg("Add validate-bindings endpoint")
+	mux.Handle("/validate-bindings", &validatingWebhook{
+		validate:              pkg.ValidateBinding,
+		saRbacValidatorConfig: saRbacValidatorConfig,
+		configLoader:          configLoader,
+		maxRequestBytes:       *maxRequestBytes,
+	})
+
+	server := &http.Server{
+		Addr:              net.JoinHostPort(*listenAddress, *port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	if certificateProvider != nil {
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificateProvider.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	// The listener is started before the RBAC caches are synced so the readiness probe can report the sync state
+	logger.Info().Str("Address", server.Addr).Msg("Start http listener")
+	serverErrors := make(chan error, 1)
+	go func() {
+		if *insecureHTTP {
+			serverErrors <- server.ListenAndServe()
+			return
+		}
+		serverErrors <- server.ListenAndServeTLS("", "")
+	}()
+
+	logger.Info().Msg("Waiting for informer caches")
+	factory.WaitForCacheSync(signalCtx.Done())
+	logger.Info().Msg("Informer caches synced")
+
+	exitCode := 0
+	select {
+	case err := <-serverErrors:
+		logger.Error().Err(err).Msg("Error creating http listener")
+		exitCode = 1
+	case <-signalCtx.Done():
+		logger.Info().Msg("Received termination signal, draining http listener")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("Failed to gracefully shutdown http listener")
+	}
+
+	logger.Info().Msg("Stopping informers")
+	close(stopper)
+	factory.Shutdown()
+	if tokenSecretFactory != nil {
+		tokenSecretFactory.Shutdown()
+	}
+	logger.Info().Msg("Shutdown complete")
+	return exitCode
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	pkg "github.com/flyingdogfood/sa-rbac-validator/pkg"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const testNamespace = "team"
+
+func newTestWebhook(t *testing.T) *validatingWebhook {
+	t.Helper()
+	configLoader, err := pkg.NewConfigLoader("", 0, pkg.Config{
+		ServiceAccountJsonPointer: "/spec/serviceAccountName",
+		SaNotFoundBehavior:        "deny",
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := pkg.NewMemoryRBACSource(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: testNamespace},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "create"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: testNamespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "pods"},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.UserKind, Name: "alice"},
+				{Kind: rbacv1.ServiceAccountKind, Name: "builder", Namespace: testNamespace},
+			},
+		},
+	)
+	return &validatingWebhook{
+		validate:              pkg.Validate,
+		saRbacValidatorConfig: pkg.SaRbacValidatorConfig{Logger: zerolog.Nop(), Source: source},
+		configLoader:          configLoader,
+		maxRequestBytes:       defaultMaxRequestBytes,
+	}
+}
+
+func newTestRequest(serviceAccount string, username string) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      "test",
+		Namespace: testNamespace,
+		Operation: admissionv1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: username, Groups: []string{"system:authenticated"}},
+		Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"},"spec":{"serviceAccountName":"` + serviceAccount + `"}}`)},
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mutex sync.Mutex
+	attributes := make(map[string]string)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var export coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("failed to decode OTLP request: %v", err)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					for _, attribute := range span.Attributes {
+						if attribute.Key == "admission.request.uid" {
+							attributes[span.Name] = attribute.Value.GetStringValue()
+						}
+					}
+				}
+			}
+		}
+		response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(response)
+	}))
+	defer collector.Close()
+	collectorURL, err := url.Parse(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SetupTracing replaces the global provider and propagator used by the other tests
+	tracerProvider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	shutdown, err := pkg.SetupTracing(context.Background(), collectorURL.Host, true, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: pkg.AdmissionReviewV1, Kind: "AdmissionReview"},
+		Request:  newTestRequest("builder", "alice"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	newTestWebhook(t).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, name := range []string{"ServeHTTP", "ResolveServiceAccount", "NamespacedScan", "ClusterScopeComparison"} {
+		if uid, ok := attributes[name]; !ok || uid != "test-uid" {
+			t.Errorf("expected span %s with request UID test-uid, got spans %v", name, attributes)
+		}
+	}
+}
+
+func TestServeHTTPAdmissionReviewVersions(t *testing.T) {
+	request := newTestRequest("builder", "alice")
+	v1Review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: pkg.AdmissionReviewV1, Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1beta1Review, err := json.Marshal(admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: pkg.AdmissionReviewV1beta1, Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       request.UID,
+			Kind:      request.Kind,
+			Resource:  request.Resource,
+			Name:      request.Name,
+			Namespace: request.Namespace,
+			Operation: admissionv1beta1.Create,
+			UserInfo:  request.UserInfo,
+			Object:    request.Object,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		body       []byte
+		apiVersion string
+		code       int
+		allowed    bool
+	}{
+		{name: "v1", body: v1Review, apiVersion: pkg.AdmissionReviewV1, code: http.StatusOK, allowed: true},
+		{name: "v1beta1", body: v1beta1Review, apiVersion: pkg.AdmissionReviewV1beta1, code: http.StatusOK, allowed: true},
+		{name: "v1beta1 without request", body: []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`), apiVersion: pkg.AdmissionReviewV1beta1, code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			newTestWebhook(t).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(test.body)))
+			if recorder.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, recorder.Code, recorder.Body.String())
+			}
+			// Both versions share the fields checked here
+			var review admissionv1beta1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+			if review.APIVersion != test.apiVersion || review.Kind != "AdmissionReview" {
+				t.Errorf("expected an AdmissionReview of %s, got %+v", test.apiVersion, review.TypeMeta)
+			}
+			if review.Response == nil {
+				t.Fatal("expected a response")
+			}
+			if review.Response.Allowed != test.allowed {
+				t.Errorf("expected allowed %t, got %t: %v", test.allowed, review.Response.Allowed, review.Response.Result)
+			}
+			if test.code == http.StatusOK && review.Response.UID != request.UID {
+				t.Errorf("expected response UID %s, got %s", request.UID, review.Response.UID)
+			}
+		})
+	}
+}
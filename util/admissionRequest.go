@@ -9,6 +9,7 @@ import (
 
 	jsonpointer "github.com/go-openapi/jsonpointer"
 	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 )
 
 func ExtractUser(request *admissionv1.AdmissionRequest) user.Info {
@@ -40,3 +41,32 @@ func ExtractServiceAccount(request *admissionv1.AdmissionRequest, jsonPointer st
 	}
 	return val.(string), nil
 }
+
+// ExtractPodSpec returns the PodSpec under jsonPointer in the object of the request
+func ExtractPodSpec(request *admissionv1.AdmissionRequest, jsonPointer string) (*corev1.PodSpec, error) {
+	ptr, err := jsonpointer.New(jsonPointer)
+	if err != nil {
+		return nil, err
+	}
+	var object interface{}
+	err = json.Unmarshal(request.Object.Raw, &object)
+	if err != nil {
+		return nil, err
+	}
+	val, kind, err := ptr.Get(object)
+	if err != nil {
+		return nil, err
+	}
+	if kind != reflect.Map {
+		return nil, errors.New("Expected object but got " + kind.String() + " for jsonPointer: " + jsonPointer)
+	}
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	var podSpec corev1.PodSpec
+	if err := json.Unmarshal(raw, &podSpec); err != nil {
+		return nil, err
+	}
+	return &podSpec, nil
+}
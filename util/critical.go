@@ -0,0 +1,52 @@
+package util
+
+import (
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// CriticalVerbs are the verbs that allow a subject to gain any permission
+var CriticalVerbs = []string{"escalate", "bind", "impersonate"}
+
+// isCriticalTarget reports if verb on resource in apiGroup allows a subject to gain any permission.
+// escalate and bind apply to Roles and ClusterRoles, impersonate to users, groups, ServiceAccounts, uids and user extras.
+func isCriticalTarget(verb string, apiGroup string, resource string) bool {
+	matches := func(value string, target string) bool {
+		return value == rbacv1.ResourceAll || value == target
+	}
+	switch verb {
+	case "escalate", "bind":
+		return matches(apiGroup, rbacv1.GroupName) && (matches(resource, "roles") || matches(resource, "clusterroles"))
+	case "impersonate":
+		if matches(apiGroup, "") && (matches(resource, "users") || matches(resource, "groups") || matches(resource, "serviceaccounts")) {
+			return true
+		}
+		// User extras are impersonated as the subresource of userextras named by the key of the extra
+		return matches(apiGroup, "authentication.k8s.io") && (matches(resource, "uids") || strings.HasPrefix(resource, "userextras/") || strings.HasPrefix(resource, "*/"))
+	}
+	return false
+}
+
+// CriticalRules returns the compacted rules of rules that grant escalate, bind or impersonate, reduced to these verbs.
+// Scoping by resourceNames, e.g. impersonation of single users, is preserved.
+func CriticalRules(rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	critical := NewRuleSet()
+	for _, rule := range ExtendRules(rules) {
+		if len(rule.NonResourceURLs) > 0 {
+			continue
+		}
+		verbs := NewVerbSet(rule.Verbs...)
+		var criticalVerbs []string
+		for _, verb := range CriticalVerbs {
+			if verbs.Has(verb) && isCriticalTarget(verb, rule.APIGroups[0], rule.Resources[0]) {
+				criticalVerbs = append(criticalVerbs, verb)
+			}
+		}
+		if len(criticalVerbs) > 0 {
+			rule.Verbs = criticalVerbs
+			critical.Add(rule)
+		}
+	}
+	return critical.CompactRules()
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// ReadManifests reads all YAML and JSON documents of the files and directories in paths and returns them as JSON.
+// Directories are read recursively, "-" reads from stdin and lists are expanded into their items.
+func ReadManifests(paths []string) ([][]byte, error) {
+	var manifests [][]byte
+	for _, path := range paths {
+		if path == "-" {
+			documents, err := readDocuments(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, documents...)
+			continue
+		}
+		files, err := manifestFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			reader, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			documents, err := readDocuments(reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, documents...)
+		}
+	}
+	return manifests, nil
+}
+
+func manifestFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		extension := strings.ToLower(filepath.Ext(file))
+		if !entry.IsDir() && (extension == ".yaml" || extension == ".yml" || extension == ".json") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func readDocuments(reader io.Reader) ([][]byte, error) {
+	var documents [][]byte
+	yamlReader := utilyaml.NewYAMLReader(bufio.NewReader(reader))
+	for {
+		document, err := yamlReader.Read()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+		jsonDocument, err := yaml.YAMLToJSON(document)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(jsonDocument, []byte("null")) {
+			continue
+		}
+		documents = append(documents, expandList(jsonDocument)...)
+	}
+}
+
+func expandList(document []byte) [][]byte {
+	var list struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(document, &list); err != nil || !strings.HasSuffix(list.Kind, "List") {
+		return [][]byte{document}
+	}
+	var documents [][]byte
+	for _, item := range list.Items {
+		documents = append(documents, expandList(item)...)
+	}
+	return documents
+}
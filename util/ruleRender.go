@@ -0,0 +1,64 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	RulesFormatTable = "table"
+	RulesFormatYAML  = "yaml"
+	RulesFormatJSON  = "json"
+)
+
+// RenderRules renders rules in format, which is one of RulesFormatTable, RulesFormatYAML and RulesFormatJSON
+func RenderRules(rules []rbacv1.PolicyRule, format string) (string, error) {
+	switch format {
+	case RulesFormatTable:
+		return RulesToTable(rules), nil
+	case RulesFormatYAML:
+		return RulesToYAML(rules)
+	case RulesFormatJSON:
+		return RulesToString(rules)
+	}
+	return "", errors.New("Unknown rules format: " + format)
+}
+
+// RulesToYAML renders rules as the rules field of a Role, ready to be pasted into a manifest
+func RulesToYAML(rules []rbacv1.PolicyRule) (string, error) {
+	result, err := yaml.Marshal(struct {
+		Rules []rbacv1.PolicyRule `json:"rules"`
+	}{Rules: rules})
+	return string(result), err
+}
+
+// RulesToTable renders rules like kubectl describe role, with one line per resource or nonResourceURL
+func RulesToTable(rules []rbacv1.PolicyRule) string {
+	var buffer bytes.Buffer
+	writer := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "Resources\tNon-Resource URLs\tResource Names\tVerbs")
+	fmt.Fprintln(writer, "---------\t-----------------\t--------------\t-----")
+	for _, rule := range rules {
+		verbs := "[" + strings.Join(rule.Verbs, " ") + "]"
+		resourceNames := "[" + strings.Join(rule.ResourceNames, " ") + "]"
+		for _, apiGroup := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if apiGroup != "" {
+					resource = resource + "." + apiGroup
+				}
+				fmt.Fprintf(writer, "%s\t[]\t%s\t%s\n", resource, resourceNames, verbs)
+			}
+		}
+		if len(rule.NonResourceURLs) > 0 {
+			fmt.Fprintf(writer, "\t[%s]\t[]\t%s\n", strings.Join(rule.NonResourceURLs, " "), verbs)
+		}
+	}
+	writer.Flush()
+	return buffer.String()
+}
@@ -0,0 +1,502 @@
+package util
+
+import (
+	"sort"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// standardVerbs are the verbs represented as bits of a VerbSet, other verbs are stored by name
+var standardVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection", "escalate", "bind", "impersonate", "use", "approve", "sign"}
+
+var standardVerbBits = func() map[string]uint32 {
+	bits := make(map[string]uint32, len(standardVerbs))
+	for index, verb := range standardVerbs {
+		bits[verb] = 1 << index
+	}
+	return bits
+}()
+
+// allVerbs is the bit of the verb *
+const allVerbs uint32 = 1 << 31
+
+// VerbSet is a set of verbs. The zero value is the empty set.
+type VerbSet struct {
+	bits uint32
+	// custom holds the sorted verbs that are no standardVerbs
+	custom []string
+}
+
+// NewVerbSet returns the VerbSet of verbs
+func NewVerbSet(verbs ...string) VerbSet {
+	var verbSet VerbSet
+	for _, verb := range verbs {
+		if verb == rbacv1.VerbAll {
+			return VerbSet{bits: allVerbs}
+		}
+		if bit, ok := standardVerbBits[verb]; ok {
+			verbSet.bits |= bit
+			continue
+		}
+		verbSet.custom = insertSorted(verbSet.custom, verb)
+	}
+	return verbSet
+}
+
+// IsEmpty reports if the set contains no verb
+func (v VerbSet) IsEmpty() bool {
+	return v.bits == 0 && len(v.custom) == 0
+}
+
+// Has reports if the set allows verb
+func (v VerbSet) Has(verb string) bool {
+	if v.bits&allVerbs != 0 {
+		return true
+	}
+	if bit, ok := standardVerbBits[verb]; ok {
+		return v.bits&bit != 0
+	}
+	index := sort.SearchStrings(v.custom, verb)
+	return index < len(v.custom) && v.custom[index] == verb
+}
+
+// Union returns the verbs of both sets
+func (v VerbSet) Union(other VerbSet) VerbSet {
+	if v.bits&allVerbs != 0 || other.bits&allVerbs != 0 {
+		return VerbSet{bits: allVerbs}
+	}
+	union := VerbSet{bits: v.bits | other.bits, custom: v.custom}
+	for _, verb := range other.custom {
+		union.custom = insertSorted(union.custom, verb)
+	}
+	return union
+}
+
+// Difference returns the verbs of v that are not allowed by other. * is only removed by *.
+func (v VerbSet) Difference(other VerbSet) VerbSet {
+	if other.bits&allVerbs != 0 {
+		return VerbSet{}
+	}
+	if v.bits&allVerbs != 0 {
+		return v
+	}
+	difference := VerbSet{bits: v.bits &^ other.bits}
+	for _, verb := range v.custom {
+		if !other.Has(verb) {
+			difference.custom = append(difference.custom, verb)
+		}
+	}
+	return difference
+}
+
+// Intersect returns the verbs allowed by both sets
+func (v VerbSet) Intersect(other VerbSet) VerbSet {
+	if v.bits&allVerbs != 0 {
+		return other
+	}
+	if other.bits&allVerbs != 0 {
+		return v
+	}
+	intersection := VerbSet{bits: v.bits & other.bits}
+	for _, verb := range v.custom {
+		if other.Has(verb) {
+			intersection.custom = append(intersection.custom, verb)
+		}
+	}
+	return intersection
+}
+
+// Covers reports if every verb of other is allowed by v
+func (v VerbSet) Covers(other VerbSet) bool {
+	return other.Difference(v).IsEmpty()
+}
+
+// Verbs returns the verbs of the set, standard verbs first
+func (v VerbSet) Verbs() []string {
+	if v.bits&allVerbs != 0 {
+		return []string{rbacv1.VerbAll}
+	}
+	var verbs []string
+	for _, verb := range standardVerbs {
+		if v.bits&standardVerbBits[verb] != 0 {
+			verbs = append(verbs, verb)
+		}
+	}
+	return append(verbs, v.custom...)
+}
+
+func insertSorted(values []string, value string) []string {
+	index := sort.SearchStrings(values, value)
+	if index < len(values) && values[index] == value {
+		return values
+	}
+	inserted := make([]string, 0, len(values)+1)
+	inserted = append(inserted, values[:index]...)
+	inserted = append(inserted, value)
+	return append(inserted, values[index:]...)
+}
+
+// RuleSet holds the permissions of PolicyRules as a tree of apiGroup, resource and resourceName with the allowed verbs
+// at every resource and resourceName. Wildcards are stored as their own nodes and are resolved on lookup.
+type RuleSet struct {
+	groups          map[string]map[string]*resourceNode
+	nonResourceURLs map[string]VerbSet
+}
+
+// resourceNode holds the verbs allowed on all objects of a resource and on single resourceNames
+type resourceNode struct {
+	verbs VerbSet
+	names map[string]VerbSet
+}
+
+// NewRuleSet returns the RuleSet of rules
+func NewRuleSet(rules ...rbacv1.PolicyRule) *RuleSet {
+	ruleSet := &RuleSet{
+		groups:          make(map[string]map[string]*resourceNode),
+		nonResourceURLs: make(map[string]VerbSet),
+	}
+	ruleSet.Add(rules...)
+	return ruleSet
+}
+
+// Add adds the permissions of rules to the set
+func (s *RuleSet) Add(rules ...rbacv1.PolicyRule) {
+	for _, rule := range rules {
+		verbs := NewVerbSet(rule.Verbs...)
+		if verbs.IsEmpty() {
+			continue
+		}
+		for _, apiGroup := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if len(rule.ResourceNames) == 0 {
+					s.addVerbs(apiGroup, resource, "", verbs)
+					continue
+				}
+				for _, resourceName := range rule.ResourceNames {
+					s.addVerbs(apiGroup, resource, resourceName, verbs)
+				}
+			}
+		}
+		for _, nonResourceURL := range rule.NonResourceURLs {
+			s.nonResourceURLs[nonResourceURL] = s.nonResourceURLs[nonResourceURL].Union(verbs)
+		}
+	}
+}
+
+// addVerbs adds verbs to the resourceName, or to all objects of the resource if resourceName is empty
+func (s *RuleSet) addVerbs(apiGroup string, resource string, resourceName string, verbs VerbSet) {
+	resources, ok := s.groups[apiGroup]
+	if !ok {
+		resources = make(map[string]*resourceNode)
+		s.groups[apiGroup] = resources
+	}
+	node, ok := resources[resource]
+	if !ok {
+		node = &resourceNode{}
+		resources[resource] = node
+	}
+	if resourceName == "" {
+		node.verbs = node.verbs.Union(verbs)
+		return
+	}
+	if node.names == nil {
+		node.names = make(map[string]VerbSet)
+	}
+	node.names[resourceName] = node.names[resourceName].Union(verbs)
+}
+
+// Union returns a new RuleSet with the permissions of both sets
+func (s *RuleSet) Union(other *RuleSet) *RuleSet {
+	union := NewRuleSet()
+	union.merge(s)
+	union.merge(other)
+	return union
+}
+
+func (s *RuleSet) merge(other *RuleSet) {
+	for apiGroup, resources := range other.groups {
+		for resource, node := range resources {
+			if !node.verbs.IsEmpty() {
+				s.addVerbs(apiGroup, resource, "", node.verbs)
+			}
+			for resourceName, verbs := range node.names {
+				s.addVerbs(apiGroup, resource, resourceName, verbs)
+			}
+		}
+	}
+	for nonResourceURL, verbs := range other.nonResourceURLs {
+		s.nonResourceURLs[nonResourceURL] = s.nonResourceURLs[nonResourceURL].Union(verbs)
+	}
+}
+
+// Allows reports if the set allows verb on the resourceName of resource in apiGroup, or on all its objects if resourceName is empty
+func (s *RuleSet) Allows(apiGroup string, resource string, resourceName string, verb string) bool {
+	return s.grantedVerbs(apiGroup, resource, resourceName).Has(verb)
+}
+
+// AllowedNames returns the resourceNames of resource in apiGroup verb is allowed on, if it is not allowed on all objects
+func (s *RuleSet) AllowedNames(apiGroup string, resource string, verb string) []string {
+	names := make(map[string]bool)
+	for _, groupKey := range wildcardKeys(apiGroup) {
+		for _, resourceKey := range resourceKeys(resource) {
+			if node, ok := s.groups[groupKey][resourceKey]; ok {
+				for resourceName, verbs := range node.names {
+					if verbs.Has(verb) {
+						names[resourceName] = true
+					}
+				}
+			}
+		}
+	}
+	return sortedKeys(names)
+}
+
+// AllowsNonResourceURL reports if the set allows verb on the nonResourceURL
+func (s *RuleSet) AllowsNonResourceURL(nonResourceURL string, verb string) bool {
+	return s.grantedNonResourceVerbs(nonResourceURL).Has(verb)
+}
+
+// grantedVerbs returns the verbs allowed on the resourceName, or on all objects if resourceName is empty, including wildcards
+func (s *RuleSet) grantedVerbs(apiGroup string, resource string, resourceName string) VerbSet {
+	var granted VerbSet
+	for _, groupKey := range wildcardKeys(apiGroup) {
+		resources, ok := s.groups[groupKey]
+		if !ok {
+			continue
+		}
+		for _, resourceKey := range resourceKeys(resource) {
+			node, ok := resources[resourceKey]
+			if !ok {
+				continue
+			}
+			granted = granted.Union(node.verbs)
+			if resourceName != "" {
+				granted = granted.Union(node.names[resourceName])
+			}
+		}
+	}
+	return granted
+}
+
+func (s *RuleSet) grantedNonResourceVerbs(nonResourceURL string) VerbSet {
+	var granted VerbSet
+	for pattern, verbs := range s.nonResourceURLs {
+		if pattern == nonResourceURL || pattern == "*" || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(nonResourceURL, strings.TrimSuffix(pattern, "*"))) {
+			granted = granted.Union(verbs)
+		}
+	}
+	return granted
+}
+
+// wildcardKeys returns the keys of the nodes that match key. A wildcard is only matched by a wildcard.
+func wildcardKeys(key string) []string {
+	if key == "*" {
+		return []string{"*"}
+	}
+	return []string{key, "*"}
+}
+
+// resourceKeys returns the keys of the resource nodes that match resource, including */subresource for subresources
+func resourceKeys(resource string) []string {
+	keys := wildcardKeys(resource)
+	if index := strings.Index(resource, "/"); index > 0 && resource[:index] != "*" {
+		keys = append(keys, "*"+resource[index:])
+	}
+	return keys
+}
+
+// Difference returns the permissions of s that are not allowed by other
+func (s *RuleSet) Difference(other *RuleSet) *RuleSet {
+	difference := NewRuleSet()
+	for apiGroup, resources := range s.groups {
+		for resource, node := range resources {
+			if verbs := node.verbs.Difference(other.grantedVerbs(apiGroup, resource, "")); !verbs.IsEmpty() {
+				difference.addVerbs(apiGroup, resource, "", verbs)
+			}
+			for resourceName, nameVerbs := range node.names {
+				if verbs := nameVerbs.Difference(other.grantedVerbs(apiGroup, resource, resourceName)); !verbs.IsEmpty() {
+					difference.addVerbs(apiGroup, resource, resourceName, verbs)
+				}
+			}
+		}
+	}
+	for nonResourceURL, urlVerbs := range s.nonResourceURLs {
+		if verbs := urlVerbs.Difference(other.grantedNonResourceVerbs(nonResourceURL)); !verbs.IsEmpty() {
+			difference.nonResourceURLs[nonResourceURL] = verbs
+		}
+	}
+	return difference
+}
+
+// Intersection returns the permissions allowed by both sets
+func (s *RuleSet) Intersection(other *RuleSet) *RuleSet {
+	intersection := NewRuleSet()
+	intersection.addIntersection(s, other)
+	// Permissions of other that are only allowed through wildcards of s
+	intersection.addIntersection(other, s)
+	return intersection
+}
+
+// addIntersection adds the permissions of from that are also allowed by by
+func (s *RuleSet) addIntersection(from *RuleSet, by *RuleSet) {
+	for apiGroup, resources := range from.groups {
+		for resource, node := range resources {
+			if verbs := node.verbs.Intersect(by.grantedVerbs(apiGroup, resource, "")); !verbs.IsEmpty() {
+				s.addVerbs(apiGroup, resource, "", verbs)
+			}
+			for resourceName, nameVerbs := range node.names {
+				if verbs := nameVerbs.Intersect(by.grantedVerbs(apiGroup, resource, resourceName)); !verbs.IsEmpty() {
+					s.addVerbs(apiGroup, resource, resourceName, verbs)
+				}
+			}
+		}
+	}
+	for nonResourceURL, urlVerbs := range from.nonResourceURLs {
+		if verbs := urlVerbs.Intersect(by.grantedNonResourceVerbs(nonResourceURL)); !verbs.IsEmpty() {
+			s.nonResourceURLs[nonResourceURL] = s.nonResourceURLs[nonResourceURL].Union(verbs)
+		}
+	}
+}
+
+// Covers reports if s allows every permission of other
+func (s *RuleSet) Covers(other *RuleSet) bool {
+	return other.Difference(s).IsEmpty()
+}
+
+// IsEmpty reports if the set allows nothing
+func (s *RuleSet) IsEmpty() bool {
+	return len(s.groups) == 0 && len(s.nonResourceURLs) == 0
+}
+
+// Rules returns the permissions of the set as sorted rules with a single apiGroup, resource and resourceName or nonResourceURL each
+func (s *RuleSet) Rules() []rbacv1.PolicyRule {
+	var rules []rbacv1.PolicyRule
+	for _, apiGroup := range sortedKeys(s.groups) {
+		resources := s.groups[apiGroup]
+		for _, resource := range sortedKeys(resources) {
+			node := resources[resource]
+			if !node.verbs.IsEmpty() {
+				rules = append(rules, rbacv1.PolicyRule{
+					APIGroups: []string{apiGroup},
+					Resources: []string{resource},
+					Verbs:     node.verbs.Verbs(),
+				})
+			}
+			for _, resourceName := range sortedKeys(node.names) {
+				rules = append(rules, rbacv1.PolicyRule{
+					APIGroups:     []string{apiGroup},
+					Resources:     []string{resource},
+					ResourceNames: []string{resourceName},
+					Verbs:         node.names[resourceName].Verbs(),
+				})
+			}
+		}
+	}
+	for _, nonResourceURL := range sortedKeys(s.nonResourceURLs) {
+		rules = append(rules, rbacv1.PolicyRule{
+			NonResourceURLs: []string{nonResourceURL},
+			Verbs:           s.nonResourceURLs[nonResourceURL].Verbs(),
+		})
+	}
+	return rules
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CompactRules returns the permissions of the set as few rules, grouping resourceNames, resources, apiGroups and
+// nonResourceURLs with equal verbs. Verbs on resourceNames that are allowed for the whole resource are omitted.
+func (s *RuleSet) CompactRules() []rbacv1.PolicyRule {
+	// Rules of a single apiGroup and resource, grouped by verbs and resourceNames
+	type resourceRule struct {
+		apiGroup      string
+		resource      string
+		resourceNames []string
+		verbs         VerbSet
+	}
+	var resourceRules []resourceRule
+	for _, apiGroup := range sortedKeys(s.groups) {
+		resources := s.groups[apiGroup]
+		for _, resource := range sortedKeys(resources) {
+			node := resources[resource]
+			if !node.verbs.IsEmpty() {
+				resourceRules = append(resourceRules, resourceRule{apiGroup: apiGroup, resource: resource, verbs: node.verbs})
+			}
+			namesByVerbs := make(map[string]*resourceRule)
+			var order []string
+			for _, resourceName := range sortedKeys(node.names) {
+				verbs := node.names[resourceName].Difference(node.verbs)
+				if verbs.IsEmpty() {
+					continue
+				}
+				key := strings.Join(verbs.Verbs(), ",")
+				if _, ok := namesByVerbs[key]; !ok {
+					namesByVerbs[key] = &resourceRule{apiGroup: apiGroup, resource: resource, verbs: verbs}
+					order = append(order, key)
+				}
+				namesByVerbs[key].resourceNames = append(namesByVerbs[key].resourceNames, resourceName)
+			}
+			for _, key := range order {
+				resourceRules = append(resourceRules, *namesByVerbs[key])
+			}
+		}
+	}
+
+	// Merge the resources of rules with equal apiGroup, resourceNames and verbs
+	var rules []rbacv1.PolicyRule
+	byResources := make(map[string]int)
+	for _, resourceRule := range resourceRules {
+		verbs := resourceRule.verbs.Verbs()
+		key := resourceRule.apiGroup + "\x00" + strings.Join(resourceRule.resourceNames, ",") + "\x00" + strings.Join(verbs, ",")
+		if index, ok := byResources[key]; ok {
+			rules[index].Resources = append(rules[index].Resources, resourceRule.resource)
+			continue
+		}
+		byResources[key] = len(rules)
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups:     []string{resourceRule.apiGroup},
+			Resources:     []string{resourceRule.resource},
+			ResourceNames: resourceRule.resourceNames,
+			Verbs:         verbs,
+		})
+	}
+
+	// Merge the apiGroups of rules with equal resources, resourceNames and verbs
+	var compacted []rbacv1.PolicyRule
+	byGroups := make(map[string]int)
+	for _, rule := range rules {
+		key := strings.Join(rule.Resources, ",") + "\x00" + strings.Join(rule.ResourceNames, ",") + "\x00" + strings.Join(rule.Verbs, ",")
+		if index, ok := byGroups[key]; ok {
+			compacted[index].APIGroups = append(compacted[index].APIGroups, rule.APIGroups...)
+			continue
+		}
+		byGroups[key] = len(compacted)
+		compacted = append(compacted, rule)
+	}
+
+	// Merge the nonResourceURLs with equal verbs
+	byVerbs := make(map[string]int)
+	for _, nonResourceURL := range sortedKeys(s.nonResourceURLs) {
+		verbs := s.nonResourceURLs[nonResourceURL].Verbs()
+		key := strings.Join(verbs, ",")
+		if index, ok := byVerbs[key]; ok {
+			compacted[index].NonResourceURLs = append(compacted[index].NonResourceURLs, nonResourceURL)
+			continue
+		}
+		byVerbs[key] = len(compacted)
+		compacted = append(compacted, rbacv1.PolicyRule{NonResourceURLs: []string{nonResourceURL}, Verbs: verbs})
+	}
+	return compacted
+}
+
+// CompactRules returns the permissions of rules as few rules
+func CompactRules(rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	return NewRuleSet(rules...).CompactRules()
+}
@@ -0,0 +1,362 @@
+package util
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestVerbSet(t *testing.T) {
+	verbs := NewVerbSet("get", "list", "custom", "get")
+	if !reflect.DeepEqual(verbs.Verbs(), []string{"get", "list", "custom"}) {
+		t.Errorf("unexpected verbs %v", verbs.Verbs())
+	}
+	if !verbs.Has("custom") || verbs.Has("delete") {
+		t.Errorf("unexpected membership of %v", verbs.Verbs())
+	}
+	if difference := verbs.Difference(NewVerbSet("list")); !reflect.DeepEqual(difference.Verbs(), []string{"get", "custom"}) {
+		t.Errorf("unexpected difference %v", difference.Verbs())
+	}
+	if !NewVerbSet("*").Covers(verbs) || verbs.Covers(NewVerbSet("*")) {
+		t.Error("only * covers *")
+	}
+}
+
+func TestRuleSetDifference(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     []rbacv1.PolicyRule
+		rules    []rbacv1.PolicyRule
+		expected []rbacv1.PolicyRule
+	}{
+		{
+			name:  "covered verbs",
+			base:  []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods", "secrets"}, Verbs: []string{"get", "list"}}},
+			rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+		{
+			name:     "missing verbs",
+			base:     []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+			rules:    []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "delete"}}},
+			expected: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"delete"}}},
+		},
+		{
+			name:  "wildcards cover everything",
+			base:  []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}, {NonResourceURLs: []string{"*"}, Verbs: []string{"*"}}},
+			rules: []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"deployments/scale"}, ResourceNames: []string{"web"}, Verbs: []string{"update"}}, {NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get"}}},
+		},
+		{
+			name:     "wildcards are only covered by wildcards",
+			base:     []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"*"}}},
+			rules:    []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"*"}, Verbs: []string{"get"}}},
+			expected: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"*"}, Verbs: []string{"get"}}},
+		},
+		{
+			name:  "subresource wildcard",
+			base:  []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"*/scale"}, Verbs: []string{"update"}}},
+			rules: []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"deployments/scale"}, Verbs: []string{"update"}}},
+		},
+		{
+			name:  "resource names are covered by the resource",
+			base:  []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}},
+			rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"a", "b"}, Verbs: []string{"get"}}},
+		},
+		{
+			name:     "the resource is not covered by resource names",
+			base:     []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"a"}, Verbs: []string{"get"}}},
+			rules:    []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"a", "b"}, Verbs: []string{"get"}}, {APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"list"}}},
+			expected: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"list"}}, {APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"b"}, Verbs: []string{"get"}}},
+		},
+		{
+			name:     "non resource url prefix",
+			base:     []rbacv1.PolicyRule{{NonResourceURLs: []string{"/metrics/*"}, Verbs: []string{"get"}}},
+			rules:    []rbacv1.PolicyRule{{NonResourceURLs: []string{"/metrics/cadvisor", "/healthz"}, Verbs: []string{"get"}}},
+			expected: []rbacv1.PolicyRule{{NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get"}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := NewRuleSet(test.base...)
+			rules := NewRuleSet(test.rules...)
+			difference := rules.Difference(base).Rules()
+			if !reflect.DeepEqual(difference, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, difference)
+			}
+			if base.Covers(rules) != (len(test.expected) == 0) {
+				t.Errorf("Covers does not match the difference %v", difference)
+			}
+			if !base.Union(rules).Covers(rules) || !base.Union(rules).Covers(base) {
+				t.Error("the union does not cover both sets")
+			}
+		})
+	}
+}
+
+func TestRuleSetIntersection(t *testing.T) {
+	serviceAccount := NewRuleSet(
+		rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}},
+	)
+	requester := NewRuleSet(
+		rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}},
+		rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"a"}, Verbs: []string{"get"}},
+	)
+	expected := requester.Rules()
+	if intersection := serviceAccount.Intersection(requester).Rules(); !reflect.DeepEqual(intersection, expected) {
+		t.Errorf("expected %v, got %v", expected, intersection)
+	}
+	if intersection := requester.Intersection(serviceAccount).Rules(); !reflect.DeepEqual(intersection, expected) {
+		t.Errorf("expected %v, got %v", expected, intersection)
+	}
+	partial := NewRuleSet(rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "delete"}})
+	expected = []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}
+	if intersection := partial.Intersection(requester).Rules(); !reflect.DeepEqual(intersection, expected) {
+		t.Errorf("expected %v, got %v", expected, intersection)
+	}
+}
+
+func TestRuleSetAllows(t *testing.T) {
+	ruleSet := NewRuleSet(
+		rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"token"}, Verbs: []string{"get"}},
+		rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"pods"}, Verbs: []string{"create"}},
+	)
+	if !ruleSet.Allows("", "secrets", "token", "get") || ruleSet.Allows("", "secrets", "", "get") || ruleSet.Allows("", "secrets", "other", "get") {
+		t.Error("unexpected access to secrets")
+	}
+	if !ruleSet.Allows("", "pods", "", "create") || ruleSet.Allows("", "pods", "", "delete") {
+		t.Error("unexpected access to pods")
+	}
+}
+
+func TestCompactRules(t *testing.T) {
+	rules := []rbacv1.PolicyRule{
+		{APIGroups: []string{"", "apps"}, Resources: []string{"configmaps", "secrets"}, Verbs: []string{"list", "get"}},
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"a", "b"}, Verbs: []string{"get", "delete"}},
+		{NonResourceURLs: []string{"/healthz", "/livez"}, Verbs: []string{"get"}},
+	}
+	expected := []rbacv1.PolicyRule{
+		{APIGroups: []string{"", "apps"}, Resources: []string{"configmaps", "secrets"}, Verbs: []string{"get", "list"}},
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"a", "b"}, Verbs: []string{"delete"}},
+		{NonResourceURLs: []string{"/healthz", "/livez"}, Verbs: []string{"get"}},
+	}
+	compacted := CompactRules(ExtendRules(rules))
+	if !reflect.DeepEqual(compacted, expected) {
+		t.Errorf("expected %v, got %v", expected, compacted)
+	}
+	if !NewRuleSet(compacted...).Covers(NewRuleSet(rules...)) || !NewRuleSet(rules...).Covers(NewRuleSet(compacted...)) {
+		t.Error("compacted rules do not hold the same permissions")
+	}
+}
+
+// clusterAdminScaleRules returns rules of the size of the aggregated admin roles of a cluster with many CRDs
+func clusterAdminScaleRules(groups int, resources int, verbs []string) []rbacv1.PolicyRule {
+	var rules []rbacv1.PolicyRule
+	for group := 0; group < groups; group++ {
+		rule := rbacv1.PolicyRule{APIGroups: []string{"group" + strconv.Itoa(group) + ".example.com"}, Verbs: verbs}
+		for resource := 0; resource < resources; resource++ {
+			rule.Resources = append(rule.Resources, "resource"+strconv.Itoa(resource), "resource"+strconv.Itoa(resource)+"/status")
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+var benchmarkVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+
+func BenchmarkRuleEscalation(b *testing.B) {
+	base := clusterAdminScaleRules(50, 20, benchmarkVerbs)
+	rules := clusterAdminScaleRules(50, 20, benchmarkVerbs[:3])
+	b.Run("RuleSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			IsRuleEscalation(base, rules)
+		}
+	})
+	b.Run("SliceScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sliceIsRuleEscalation(base, rules)
+		}
+	})
+}
+
+func BenchmarkExtendRules(b *testing.B) {
+	rules := clusterAdminScaleRules(50, 20, benchmarkVerbs)
+	b.Run("RuleSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ExtendRules(rules)
+		}
+	})
+	b.Run("SliceScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sliceExtendRules(rules)
+		}
+	})
+}
+
+// The slice based implementation replaced by RuleSet, kept as baseline for the benchmarks
+
+func sliceIsRuleEscalation(baseRules []rbacv1.PolicyRule, escalationRules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	baseRules = sliceExtendRules(baseRules)
+	escalationRules = sliceExtendRules(escalationRules)
+	var escalatedRules []rbacv1.PolicyRule
+
+	for _, escalationRule := range escalationRules {
+		matched := false
+		for _, baseRule := range baseRules {
+			if len(escalationRule.NonResourceURLs) > 0 {
+				if len(baseRule.NonResourceURLs) > 0 {
+					if escalationRule.NonResourceURLs[0] == baseRule.NonResourceURLs[0] {
+						matched = true
+						continue
+					}
+					continue
+				}
+				continue
+			}
+			if len(baseRule.NonResourceURLs) == 0 && escalationRule.APIGroups[0] == baseRule.APIGroups[0] && escalationRule.Resources[0] == baseRule.Resources[0] {
+				if len(escalationRule.ResourceNames) > 0 {
+					if len(baseRule.ResourceNames) > 0 {
+						if escalationRule.ResourceNames[0] == baseRule.ResourceNames[0] {
+							matched = true
+							continue
+						}
+						continue
+					}
+					continue
+				}
+				matched = true
+				continue
+			}
+		}
+		if !matched {
+			escalatedRules = append(escalatedRules, escalationRule)
+		}
+		matched = false
+	}
+	return escalatedRules
+}
+
+func sliceExtendRules(rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	var extendedRules []rbacv1.PolicyRule
+	for _, rule := range rules {
+		for _, apiGroup := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if len(rule.ResourceNames) > 0 {
+					for _, resouceName := range rule.ResourceNames {
+						extendedRules = sliceAddRule(extendedRules, rbacv1.PolicyRule{
+							APIGroups:     []string{apiGroup},
+							Resources:     []string{resource},
+							ResourceNames: []string{resouceName},
+							Verbs:         rule.Verbs,
+						})
+					}
+				} else {
+					extendedRules = sliceAddRule(extendedRules, rbacv1.PolicyRule{
+						APIGroups: []string{apiGroup},
+						Resources: []string{resource},
+						Verbs:     rule.Verbs,
+					})
+				}
+			}
+		}
+		for _, nonResourceURL := range rule.NonResourceURLs {
+			extendedRules = sliceAddRule(extendedRules, rbacv1.PolicyRule{
+				NonResourceURLs: []string{nonResourceURL},
+				Verbs:           rule.Verbs,
+			})
+		}
+	}
+	return extendedRules
+}
+
+func sliceAddRule(rules []rbacv1.PolicyRule, rule rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	index := sliceContainsRule(rules, rule)
+	if index >= 0 {
+		rules[index].Verbs = sliceMergeRuleVerbs(rules[index].Verbs, rule.Verbs)
+		return rules
+	}
+	return append(rules, rule)
+}
+
+func sliceAddRules(rules []rbacv1.PolicyRule, addRules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	for _, rule := range addRules {
+		rules = sliceAddRule(rules, rule)
+	}
+	return rules
+}
+
+func sliceContainsRule(rules []rbacv1.PolicyRule, rule rbacv1.PolicyRule) int {
+	for index, loopRule := range rules {
+		if len(loopRule.NonResourceURLs) > 0 {
+			if len(rule.NonResourceURLs) > 0 {
+				if loopRule.NonResourceURLs[0] == rule.NonResourceURLs[0] {
+					return index
+				}
+			}
+			continue
+		}
+		if len(loopRule.APIGroups) > 0 && len(loopRule.Resources) > 0 {
+			if len(rule.APIGroups) > 0 && len(rule.Resources) > 0 {
+				if loopRule.APIGroups[0] == rule.APIGroups[0] && loopRule.Resources[0] == rule.Resources[0] {
+					if len(loopRule.ResourceNames) > 0 {
+						if loopRule.ResourceNames[0] == rule.ResourceNames[0] {
+							return index
+						}
+						continue
+					}
+					return index
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func sliceMergeRuleVerbs(verbs1 []string, verbs2 []string) []string {
+	// If either verbs1 or verbs2 has the verb * we can return the rule directly
+	verbs1 = sliceReduceVerbs(verbs1)
+	verbs2 = sliceReduceVerbs(verbs2)
+	if len(verbs1) > 0 && verbs1[0] == "*" {
+		return verbs1
+	}
+	if len(verbs2) > 0 && verbs2[0] == "*" {
+		return verbs2
+	}
+	verbs := verbs1
+	for _, verb2 := range verbs2 {
+		match := false
+		for _, verb1 := range verbs1 {
+			if verb1 == verb2 {
+				match = true
+				break
+			}
+		}
+		if !match {
+			verbs = append(verbs, verb2)
+		}
+		match = false
+	}
+	return verbs
+}
+
+func sliceReduceVerbs(verbs []string) []string {
+	var reducedVerbs []string
+	for index, verb := range verbs {
+		if verb == "*" {
+			return []string{"*"}
+		}
+		matched := false
+		for i := index + 1; i < len(verbs); i++ {
+			if verbs[i] == verb {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			reducedVerbs = append(reducedVerbs, verb)
+		}
+		matched = false
+
+	}
+	return reducedVerbs
+}
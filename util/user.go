@@ -6,12 +6,25 @@ import (
 	authenticationv1 "k8s.io/api/authentication/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
 	"k8s.io/apiserver/pkg/authentication/user"
-	rbacinformersv1 "k8s.io/client-go/informers/rbac/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ApiCallError wraps errors of calls to the kubernetes API with the name of the failed call
+type ApiCallError struct {
+	Call string
+	Err  error
+}
+
+func (e *ApiCallError) Error() string {
+	return e.Call + " failed: " + e.Err.Error()
+}
+
+func (e *ApiCallError) Unwrap() error {
+	return e.Err
+}
+
 func GetServiceAccount(client kubernetes.Interface, name string, namespace string) (user.Info, error) {
 	tokenRequest := authenticationv1.TokenRequest{
 		Spec: authenticationv1.TokenRequestSpec{
@@ -20,7 +33,7 @@ func GetServiceAccount(client kubernetes.Interface, name string, namespace strin
 	}
 	token, err := client.CoreV1().ServiceAccounts(namespace).CreateToken(context.TODO(), name, &tokenRequest, metav1.CreateOptions{})
 	if err != nil {
-		return nil, err
+		return nil, &ApiCallError{Call: "TokenRequest", Err: err}
 	}
 	review := &authenticationv1.TokenReview{
 		Spec: authenticationv1.TokenReviewSpec{
@@ -31,11 +44,11 @@ func GetServiceAccount(client kubernetes.Interface, name string, namespace strin
 	// send the TokenReview request
 	result, err := client.AuthenticationV1().TokenReviews().Create(context.TODO(), review, metav1.CreateOptions{})
 	if err != nil {
-		return nil, err
+		return nil, &ApiCallError{Call: "TokenReview", Err: err}
 	}
 
 	var user user.Info = &user.DefaultInfo{
-		Name:   name,
+		Name:   serviceaccount.MakeUsername(namespace, name),
 		UID:    result.Status.User.UID,
 		Groups: result.Status.User.Groups,
 	}
@@ -43,6 +56,15 @@ func GetServiceAccount(client kubernetes.Interface, name string, namespace strin
 	return user, nil
 }
 
+// ServiceAccountUser returns the user.Info the apiserver authenticates for tokens of the ServiceAccount, without calling the API
+func ServiceAccountUser(name string, namespace string) user.Info {
+	return &user.DefaultInfo{
+		Name:   serviceaccount.MakeUsername(namespace, name),
+		Groups: append(serviceaccount.MakeGroupNames(namespace), user.AllAuthenticated),
+	}
+}
+
+// SubjectsMatchesUserOrServiceAccount reports if any of the subjects of a binding in namespace matches the user
 func SubjectsMatchesUserOrServiceAccount(subjects []rbacv1.Subject, user user.Info, namespace string) bool {
 	for _, subject := range subjects {
 		if SubjectMatchesUserOrServiceAccount(subject, user, namespace) {
@@ -52,33 +74,33 @@ func SubjectsMatchesUserOrServiceAccount(subjects []rbacv1.Subject, user user.In
 	return false
 }
 
+// SubjectMatchesUserOrServiceAccount reports if the subject of a binding in namespace matches the user.
+// ServiceAccount subjects without namespace belong to the namespace of the binding.
 func SubjectMatchesUserOrServiceAccount(subject rbacv1.Subject, user user.Info, namespace string) bool {
-	if subject.Kind == "User" && subject.Name == user.GetName() {
-		return true
-	}
-	if subject.Kind == "ServiceAccount" && subject.Name == user.GetName() && subject.Namespace == namespace {
-		return true
-	}
-	if subject.Kind == "Group" {
-		for _, group := range user.GetGroups() {
-			if subject.Name == group {
-				return true
-			}
+	for _, key := range UserSubjectKeys(user) {
+		if key == SubjectKey(subject, namespace) {
+			return true
 		}
 	}
 	return false
 }
 
-func GetRolesForUser(user user.Info, roleBindingInformer rbacinformersv1.RoleBindingInformer, roleInformer rbacinformersv1.RoleInformer) ([]rbacv1.Role, error) {
-	var roles []rbacv1.Role
-	roleBindings, err := roleBindingInformer.Lister().List(labels.Everything())
-	if err != nil {
-		return nil, err
-	}
-	for _, roleBinding := range roleBindings {
-		if SubjectsMatchesUserOrServiceAccount(roleBinding.Subjects, user, roleBinding.Namespace) {
-			roles = append(roles)
+// SubjectKey returns the key of the subject of a binding in namespace, it equals one of the UserSubjectKeys of every matching user
+func SubjectKey(subject rbacv1.Subject, namespace string) string {
+	if subject.Kind == rbacv1.ServiceAccountKind {
+		if subject.Namespace != "" {
+			namespace = subject.Namespace
 		}
+		return rbacv1.UserKind + ":" + serviceaccount.MakeUsername(namespace, subject.Name)
+	}
+	return subject.Kind + ":" + subject.Name
+}
+
+// UserSubjectKeys returns the keys of all subjects matching the user
+func UserSubjectKeys(user user.Info) []string {
+	keys := []string{rbacv1.UserKind + ":" + user.GetName()}
+	for _, group := range user.GetGroups() {
+		keys = append(keys, rbacv1.GroupKind+":"+group)
 	}
-	return roles, nil
+	return keys
 }
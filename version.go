@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// version is set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+func runVersion(args []string) int {
+	flags := newFlagSet("version", "", "Print the version.")
+	flags.Parse(args)
+	fmt.Printf("sa-rbac-validator %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}